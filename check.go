@@ -0,0 +1,189 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fceller/home2grafana/devices"
+	"gopkg.in/yaml.v2"
+)
+
+// healthMetrics are exported by home2grafana for every polled series.
+var healthMetrics = map[string]bool{
+	scrapeDurationName: true,
+	scrapeErrorsName:   true,
+	lastSuccessName:    true,
+	deviceUpName:       true,
+	suspendedName:      true,
+}
+
+// derivedMetrics maps the metrics exported in addition to the defined
+// metrics to the metric they are derived from: the counter, rate and resets
+// of energy metrics and the names of the values of system variables.
+func derivedMetrics(metrics map[string]map[string]bool) map[string]string {
+	derived := make(map[string]string)
+
+	for name, categories := range metrics {
+		if categories["energy"] {
+			for _, suffix := range []string{totalSuffix, rateSuffix, resetsSuffix} {
+				derived[name+"_"+suffix] = name
+			}
+		}
+
+		if categories[devices.SysvarCategory] {
+			derived[name+"_"+infoSuffix] = name
+		}
+	}
+
+	return derived
+}
+
+// isKnownMetric checks whether the name is a defined metric, one of the
+// metrics derived from it or a health metric.
+func isKnownMetric(metrics map[string]map[string]bool, name string) bool {
+	_, derived := derivedMetrics(metrics)[name]
+	return metrics[name] != nil || derived || healthMetrics[name]
+}
+
+// checkMetricConflicts reports defined metrics, which have the name of a
+// health metric or of a metric derived from another metric.
+func checkMetricConflicts(setup string, metrics map[string]map[string]bool) []devices.Diagnostic {
+	diagnostics := make([]devices.Diagnostic, 0)
+	derived := derivedMetrics(metrics)
+	names := make([]string, 0, len(metrics))
+
+	for name := range metrics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if healthMetrics[name] {
+			diagnostics = append(diagnostics, devices.Diagnostic{
+				File:    setup,
+				Message: fmt.Sprintf("metric '%s' is exported by home2grafana itself", name),
+			})
+		} else if base, ok := derived[name]; ok {
+			diagnostics = append(diagnostics, devices.Diagnostic{
+				File:    setup,
+				Message: fmt.Sprintf("metric '%s' conflicts with the metric derived from '%s'", name, base),
+			})
+		}
+	}
+
+	return diagnostics
+}
+
+func checkOverview(setup string, metrics map[string]map[string]bool) []devices.Diagnostic {
+	diagnostics := make([]devices.Diagnostic, 0)
+	path := filepath.Join(setup, "overview.yaml")
+	yfile, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return append(diagnostics, devices.Diagnostic{File: path, Message: err.Error()})
+	}
+
+	overview := Overview{}
+
+	if err = yaml.UnmarshalStrict(yfile, &overview); err != nil {
+		return append(diagnostics, devices.YamlDiagnostics(path, err)...)
+	}
+
+	lines := strings.Split(string(yfile), "\n")
+
+	for _, table := range overview.Tables {
+		for _, metric := range table.Metrics {
+			if !isKnownMetric(metrics, metric.Name) {
+				diagnostics = append(diagnostics, devices.Diagnostic{
+					File:    path,
+					Line:    devices.LineOf(lines, 0, "name", metric.Name),
+					Message: fmt.Sprintf("unknown metric '%s' in table '%s'", metric.Name, table.Title),
+				})
+			}
+		}
+
+		for _, group := range table.Group {
+			if group.Name != "room" && group.Name != "name" {
+				diagnostics = append(diagnostics, devices.Diagnostic{
+					File:    path,
+					Line:    devices.LineOf(lines, 0, "name", group.Name),
+					Message: fmt.Sprintf("unknown group '%s' in table '%s'", group.Name, table.Title),
+				})
+			}
+		}
+	}
+
+	html := filepath.Join(setup, "overview.html")
+
+	if _, err = template.ParseFiles(html); err != nil {
+		diagnostics = append(diagnostics, devices.Diagnostic{File: html, Message: err.Error()})
+	}
+
+	return diagnostics
+}
+
+// runCheck validates the setup directory and prints all problems found. It
+// returns the exit code of the check subcommand.
+func runCheck(name string, args []string, out io.Writer) int {
+	setup := ""
+
+	flagset := flag.NewFlagSet(name+" check", flag.ExitOnError)
+	flagset.StringVar(&setup, "setup", "./setup", "The directory holding the device definitions.")
+	flagset.Parse(args)
+
+	diagnostics, metrics := devices.CheckDevices(setup)
+	diagnostics = append(diagnostics, checkMetricConflicts(setup, metrics)...)
+	diagnostics = append(diagnostics, checkOverview(setup, metrics)...)
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].File != diagnostics[j].File {
+			return diagnostics[i].File < diagnostics[j].File
+		}
+
+		return diagnostics[i].Line < diagnostics[j].Line
+	})
+
+	for _, diagnostic := range diagnostics {
+		fmt.Fprintln(out, diagnostic)
+	}
+
+	if len(diagnostics) > 0 {
+		fmt.Fprintf(out, "%d problem(s) found\n", len(diagnostics))
+		return 1
+	}
+
+	fmt.Fprintln(out, "setup is valid")
+	return 0
+}
@@ -0,0 +1,101 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckMetrics(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"overview.html": "",
+		"overview.yaml": `
+tables:
+  - title: Test
+    metrics:
+    - name: energy_watthour_total
+    - name: energy_watthour_rate
+    - name: homematic_sysvar_info
+    - name: home2grafana_device_up
+    - name: temperature_celsius_total
+    - name: energy_total_info
+`,
+		"tasmota.yaml": `
+source:
+  provider: tasmota
+  energy_metric: energy_watthour
+  power_metric: energy_watthour_rate
+  temperature_metric: temperature_celsius
+  interval: 60s
+  devices:
+    - address: 192.168.160.200
+`,
+		"homematic.yaml": `
+source:
+  provider: homematic
+  address: 192.168.160.21
+  light_metric: home2grafana_device_up
+  interval: 60s
+  sysvars:
+    names: [Anwesenheit]
+`,
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := bytes.Buffer{}
+
+	if code := runCheck("home2grafana", []string{"-setup", dir}, &out); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+
+	expected := []string{
+		"metric 'energy_watthour_rate' conflicts with the metric derived from 'energy_watthour'",
+		"metric 'home2grafana_device_up' is exported by home2grafana itself",
+		"unknown metric 'temperature_celsius_total' in table 'Test'",
+		"unknown metric 'energy_total_info' in table 'Test'",
+		"4 problem(s) found",
+	}
+
+	for _, message := range expected {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected '%s' in\n%s", message, out.String())
+		}
+	}
+
+	if n := strings.Count(out.String(), "\n"); n != len(expected) {
+		t.Errorf("expected %d lines, got\n%s", len(expected), out.String())
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const totalSuffix = "total"
+const rateSuffix = "rate"
+const resetsSuffix = "resets_total"
+const infoSuffix = "info"
+
+const (
+	scrapeDurationName = "home2grafana_scrape_duration_seconds"
+	scrapeErrorsName   = "home2grafana_scrape_errors_total"
+	lastSuccessName    = "home2grafana_last_success_timestamp_seconds"
+	deviceUpName       = "home2grafana_device_up"
+	suspendedName      = "home2grafana_device_suspended"
+)
+
+// Collector exports the readings of the store. The metrics are created at
+// scrape time, so a slow device never blocks a scrape.
+type Collector struct {
+	store *Store
+}
+
+func NewCollector(store *Store) *Collector {
+	return &Collector{store: store}
+}
+
+// Describe sends no descriptors, which turns the collector into an
+// unchecked collector. The set of series is only known at scrape time.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+
+	for _, entry := range c.store.Snapshot() {
+		if entry.Polled {
+			c.collectHealth(ch, entry)
+		}
+
+		if !entry.Valid {
+			continue
+		}
+
+		d := entry.Device
+		r := entry.Reading
+		name := d.MetricName()
+		labelNames := d.LabelNames()
+		labels := d.Labels()
+		stale := r.IsStale(d, now)
+
+		if stale {
+			if d.Stale().Policy == devices.StaleDrop {
+				continue
+			}
+
+			r.Value = math.NaN()
+			r.Rate = math.NaN()
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(name, name, labelNames, nil),
+			prometheus.GaugeValue, r.Value, labels...)
+
+		if e, ok := d.(devices.Enumeration); ok && !stale {
+			if text, ok := e.ValueName(r.Value); ok {
+				info := fmt.Sprintf("%s_%s", name, infoSuffix)
+
+				ch <- prometheus.MustNewConstMetric(
+					prometheus.NewDesc(info, "name of the current value of "+name, append(labelNames, "value"), nil),
+					prometheus.GaugeValue, 1, append(labels, text)...)
+			}
+		}
+
+		if d.CategoryName() == "energy" {
+			counter := fmt.Sprintf("%s_%s", name, totalSuffix)
+
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc(counter, name, labelNames, nil),
+				prometheus.CounterValue, r.Total, labels...)
+
+			resets := fmt.Sprintf("%s_%s", name, resetsSuffix)
+
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc(resets, "number of detected resets of "+name, labelNames, nil),
+				prometheus.CounterValue, r.Resets, labels...)
+
+			if !math.IsNaN(r.Rate) {
+				avg := fmt.Sprintf("%s_%s", name, rateSuffix)
+
+				ch <- prometheus.MustNewConstMetric(
+					prometheus.NewDesc(avg, name, labelNames, nil),
+					prometheus.GaugeValue, r.Rate, labels...)
+			}
+		}
+	}
+}
+
+func (c *Collector) collectHealth(ch chan<- prometheus.Metric, entry StoreEntry) {
+	h := entry.Health
+	labelNames := append(entry.Device.LabelNames(), "metric")
+	labels := append(entry.Device.Labels(), entry.Device.MetricName())
+
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(scrapeDurationName, "duration of the latest read of a device", labelNames, nil),
+		prometheus.GaugeValue, h.Duration.Seconds(), labels...)
+
+	errorDesc := prometheus.NewDesc(
+		scrapeErrorsName, "number of failed reads of a device by kind of error", append(labelNames, "kind"), nil)
+
+	for _, kind := range errorKinds {
+		ch <- prometheus.MustNewConstMetric(
+			errorDesc, prometheus.CounterValue, h.Errors[kind], append(labels, kind)...)
+	}
+
+	if !h.LastSuccess.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(lastSuccessName, "time of the latest successful read of a device", labelNames, nil),
+			prometheus.GaugeValue, float64(h.LastSuccess.UnixNano())/1e9, labels...)
+	}
+
+	up := 0.0
+
+	if h.Up {
+		up = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(deviceUpName, "whether the latest read of a device was successful", labelNames, nil),
+		prometheus.GaugeValue, up, labels...)
+
+	suspended := 0.0
+
+	if h.Suspended {
+		suspended = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(suspendedName, "whether a device is no longer polled after an authentication failure",
+			labelNames, nil),
+		prometheus.GaugeValue, suspended, labels...)
+}
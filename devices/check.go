@@ -0,0 +1,445 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Diagnostic is a problem found while checking the setup directory.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", d.File, d.Message)
+}
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var yamlLineRE = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+var yamlFieldRE = regexp.MustCompile(`^field (\S+) not found in type .*$`)
+
+// YamlDiagnostics converts the error of the yaml parser into diagnostics,
+// one for each line the parser complained about.
+func YamlDiagnostics(path string, err error) []Diagnostic {
+	messages := []string{err.Error()}
+
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+
+	diagnostics := make([]Diagnostic, 0, len(messages))
+
+	for _, message := range messages {
+		diagnostic := Diagnostic{File: path, Message: message}
+
+		if m := yamlLineRE.FindStringSubmatch(message); m != nil {
+			diagnostic.Line, _ = strconv.Atoi(m[1])
+			diagnostic.Message = yamlFieldRE.ReplaceAllString(m[2], "unknown key '$1'")
+		}
+
+		diagnostics = append(diagnostics, diagnostic)
+	}
+
+	return diagnostics
+}
+
+// LineOf returns the first line after the line from defining the key with
+// the given value. An empty value matches any value. It returns 0 if there
+// is no such line.
+func LineOf(lines []string, from int, key string, value string) int {
+	for i := from; i < len(lines); i++ {
+		line := lines[i]
+		line = strings.TrimLeft(strings.TrimSpace(line), "- ")
+
+		if !strings.HasPrefix(line, key+":") {
+			continue
+		}
+
+		found := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, key+":")), `"'`)
+
+		if value == "" || found == value {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// itemLines returns the lines starting the items of the list defined by the
+// key. The list must be the only list with this key.
+func itemLines(lines []string, key string) []int {
+	items := make([]int, 0)
+	start := LineOf(lines, 0, key, "")
+
+	if start == 0 {
+		return items
+	}
+
+	indent := -1
+
+	for i := start; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if indent < 0 {
+			if !strings.HasPrefix(trimmed, "-") {
+				break
+			}
+
+			indent = indentation(lines[i])
+		}
+
+		if indentation(lines[i]) < indent {
+			break
+		}
+
+		if indentation(lines[i]) == indent && strings.HasPrefix(trimmed, "-") {
+			items = append(items, i+1)
+		}
+	}
+
+	return items
+}
+
+// checkHomematicProfiles validates the user-defined Homematic profiles.
+func checkHomematicProfiles(path string) []Diagnostic {
+	diagnostics := make([]Diagnostic, 0)
+	yfile, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return append(diagnostics, Diagnostic{File: path, Message: err.Error()})
+	}
+
+	profiles, err := parseHomematicProfiles(yfile)
+
+	if err != nil {
+		return append(diagnostics, YamlDiagnostics(path, err)...)
+	}
+
+	lines := strings.Split(string(yfile), "\n")
+	report := func(line int, format string, args ...interface{}) {
+		diagnostics = append(diagnostics, Diagnostic{path, line, fmt.Sprintf(format, args...)})
+	}
+
+	for hssType, datapoints := range profiles {
+		start := LineOf(lines, 0, hssType, "")
+
+		for _, dp := range datapoints {
+			if !homematicCategories[dp.Category] {
+				report(LineOf(lines, start, "category", dp.Category), "unknown category '%s' in profile '%s'", dp.Category, hssType)
+			}
+
+			if dp.Datapoint == "" {
+				report(start, "datapoint missing in profile '%s'", hssType)
+			}
+		}
+	}
+
+	return diagnostics
+}
+
+type deviceLocation struct {
+	file string
+	line int
+}
+
+// SysvarCategory is the category of the metrics of system variables in the
+// result of CheckDevices. Their values may have names.
+const SysvarCategory = "sysvar_enum"
+
+// CheckDevices validates all device files of the setup directory without
+// contacting any device. It returns the problems found and the categories
+// of all defined metrics by name.
+func CheckDevices(setup string) ([]Diagnostic, map[string]map[string]bool) {
+	yamlRE := regexp.MustCompile(`\.yaml$`)
+	diagnostics := make([]Diagnostic, 0)
+	metrics := make(map[string]map[string]bool)
+	seen := make(map[string]deviceLocation)
+
+	define := func(name string, category string) {
+		if metrics[name] == nil {
+			metrics[name] = make(map[string]bool)
+		}
+
+		metrics[name][category] = true
+	}
+
+	err := filepath.Walk(setup,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || !yamlRE.MatchString(info.Name()) || info.Name() == "overview.yaml" {
+				return nil
+			}
+
+			if info.Name() == HomematicProfilesFile {
+				diagnostics = append(diagnostics, checkHomematicProfiles(path)...)
+				return nil
+			}
+
+			yfile, err := ioutil.ReadFile(path)
+
+			if err != nil {
+				diagnostics = append(diagnostics, Diagnostic{File: path, Message: err.Error()})
+				return nil
+			}
+
+			device := Device{}
+
+			if err = yaml.UnmarshalStrict(yfile, &device); err != nil {
+				diagnostics = append(diagnostics, YamlDiagnostics(path, err)...)
+
+				// continue with the remaining checks, if only unknown keys
+				// have been found
+				device = Device{}
+
+				if yaml.Unmarshal(yfile, &device) != nil {
+					return nil
+				}
+			}
+
+			lines := strings.Split(string(yfile), "\n")
+			report := func(line int, format string, args ...interface{}) {
+				diagnostics = append(diagnostics, Diagnostic{path, line, fmt.Sprintf(format, args...)})
+			}
+
+			diagnostics = append(diagnostics, checkSource(path, lines, &device)...)
+
+			if _, err := newHomematicTransport(setup, device); err != nil {
+				report(LineOf(lines, 0, "ca_file", ""), "%v", err)
+			}
+
+			for category, name := range device.CategoryMetrics() {
+				if !metricNameRE.MatchString(name) {
+					report(LineOf(lines, 0, category+"_metric", ""), "invalid metric name '%s'", name)
+				} else {
+					define(name, category)
+				}
+			}
+
+			if device.Source.ServiceMetrics {
+				for category, name := range homematicServiceMetrics {
+					define(name, category)
+				}
+			}
+
+			if sysvars := device.Source.Sysvars; sysvars != nil {
+				if name := sysvars.MetricName(); !metricNameRE.MatchString(name) {
+					report(LineOf(lines, LineOf(lines, 0, "sysvars", ""), "metric", ""), "invalid metric name '%s'", name)
+				} else {
+					define(name, SysvarCategory)
+				}
+			}
+
+			items := itemLines(lines, "devices")
+
+			for i, d := range device.Source.Devices {
+				var id, key, value string
+
+				switch device.Source.Provider {
+				case "tasmota":
+					id, key, value = "tasmota: "+d.Address, "address", d.Address
+				case "homematic", "homematic-jsonrpc", "homematic-xmlapi":
+					id, key, value = device.Source.Provider+": "+d.HmName, "hm_name", d.HmName
+				case "iobroker":
+					id, key, value = "iobroker: "+d.Address, "address", d.Address
+				default:
+					continue
+				}
+
+				line := 0
+
+				if i < len(items) {
+					line = items[i]
+				}
+
+				if value == "" {
+					report(line, "device without %s", key)
+					continue
+				}
+
+				if device.Source.Provider == "homematic-jsonrpc" || device.Source.Provider == "homematic-xmlapi" {
+					if _, _, err := splitHmName(d.HmName); err != nil {
+						report(line, "%v", err)
+					}
+				}
+
+				if _, err := newLabelSet(nil, d.Labels); err != nil {
+					report(line, "%v", err)
+				}
+
+				switch {
+				case d.Channels == "":
+				case device.Source.Provider != "tasmota":
+					report(line, "channels is not supported by provider '%s'", device.Source.Provider)
+				case d.Channels != TasmotaChannelsChannel && d.Channels != TasmotaChannelsPhase &&
+					d.Channels != TasmotaChannelsSum:
+					report(line, "unknown channels '%s', expecting channel, phase or sum", d.Channels)
+				}
+
+				if first, ok := seen[id]; ok {
+					report(line, "duplicate device '%s', first defined at %s:%d", id, first.file, first.line)
+				} else {
+					seen[id] = deviceLocation{path, line}
+				}
+			}
+
+			return nil
+		})
+
+	if err != nil {
+		diagnostics = append(diagnostics, Diagnostic{File: setup, Message: err.Error()})
+	}
+
+	return diagnostics, metrics
+}
+
+func checkSource(path string, lines []string, device *Device) []Diagnostic {
+	diagnostics := make([]Diagnostic, 0)
+	report := func(line int, format string, args ...interface{}) {
+		diagnostics = append(diagnostics, Diagnostic{path, line, fmt.Sprintf(format, args...)})
+	}
+
+	switch device.Source.Provider {
+	case "tasmota":
+	case "homematic", "homematic-jsonrpc", "homematic-xmlapi", "iobroker":
+		if device.Source.Address == "" {
+			report(LineOf(lines, 0, "source", ""), "missing address of %s source", device.Source.Provider)
+		}
+	case "":
+		report(LineOf(lines, 0, "source", ""), "missing provider")
+	default:
+		report(LineOf(lines, 0, "provider", ""), "unknown provider '%s'", device.Source.Provider)
+	}
+
+	if device.Source.Interval == "" {
+		report(LineOf(lines, 0, "source", ""), "missing interval")
+	} else if interval, err := time.ParseDuration(device.Source.Interval); err != nil {
+		report(LineOf(lines, 0, "interval", ""), "invalid interval: %v", err)
+	} else if interval <= 0 {
+		report(LineOf(lines, 0, "interval", ""), "interval must be positive")
+	}
+
+	if device.Source.StaleAfter != "" {
+		if _, err := time.ParseDuration(device.Source.StaleAfter); err != nil {
+			report(LineOf(lines, 0, "stale_after", ""), "invalid stale_after: %v", err)
+		}
+	}
+
+	switch device.Source.StalePolicy {
+	case "", StaleDrop, StaleNaN:
+	default:
+		report(LineOf(lines, 0, "stale_policy", ""), "unknown stale policy '%s'", device.Source.StalePolicy)
+	}
+
+	if _, err := newLabelSet(device.Source.Labels, nil); err != nil {
+		report(LineOf(lines, 0, "labels", ""), "%v", err)
+	}
+
+	tls := device.Source.CaFile != "" || device.Source.InsecureSkipVerify || device.Source.ServerName != ""
+
+	if tls && !device.Source.UseSSL {
+		report(LineOf(lines, 0, "source", ""), "ca_file, insecure_skip_verify and server_name require ssl")
+	}
+
+	if device.Source.Discover && !strings.HasPrefix(device.Source.Provider, "homematic") {
+		report(LineOf(lines, 0, "discover", ""), "discover is not supported by provider '%s'", device.Source.Provider)
+	}
+
+	if device.Source.ServiceMetrics && !strings.HasPrefix(device.Source.Provider, "homematic") {
+		report(LineOf(lines, 0, "service_metrics", ""),
+			"service_metrics is not supported by provider '%s'", device.Source.Provider)
+	}
+
+	for _, key := range []string{"include", "exclude"} {
+		patterns := device.Source.Include
+
+		if key == "exclude" {
+			patterns = device.Source.Exclude
+		}
+
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				report(LineOf(lines, 0, key, ""), "invalid %s pattern '%s': %v", key, pattern, err)
+			}
+		}
+	}
+
+	if len(device.Source.Sensors) > 0 && device.Source.Provider != "tasmota" {
+		report(LineOf(lines, 0, "sensors", ""), "sensors is not supported by provider '%s'", device.Source.Provider)
+	}
+
+	if device.Source.Push && !strings.HasPrefix(device.Source.Provider, "homematic") {
+		report(LineOf(lines, 0, "push", ""), "push is not supported by provider '%s'", device.Source.Provider)
+	}
+
+	if sysvars := device.Source.Sysvars; sysvars != nil {
+		line := LineOf(lines, 0, "sysvars", "")
+
+		if !strings.HasPrefix(device.Source.Provider, "homematic") {
+			report(line, "sysvars is not supported by provider '%s'", device.Source.Provider)
+		}
+
+		if len(sysvars.Names) == 0 && sysvars.Regex == "" {
+			report(line, "sysvars without names or regex")
+		}
+
+		if _, err := regexp.Compile(sysvars.Regex); err != nil {
+			report(LineOf(lines, line, "regex", ""), "invalid sysvars regex: %v", err)
+		}
+	}
+
+	if len(device.CategoryMetrics()) == 0 && !device.Source.ServiceMetrics && device.Source.Sysvars == nil {
+		report(LineOf(lines, 0, "source", ""), "no metric defined")
+	}
+
+	return diagnostics
+}
@@ -36,6 +36,13 @@ type Context struct {
 	NetClient *http.Client
 	Clog      *logrus.Entry
 	loggers   []*logrus.Entry
+
+	// skipFailed is set while loading at startup: a device, which cannot be
+	// looked up, is skipped instead of failing the whole setup
+	skipFailed bool
+
+	// previous holds the devices of the previous load while reloading
+	previous *Devices
 }
 
 func (c *Context) PushFields(fields logrus.Fields) {
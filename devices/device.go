@@ -26,10 +26,15 @@
 package devices
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"io/ioutil"
@@ -39,25 +44,94 @@ import (
 
 type Device struct {
 	Source struct {
-		Provider          string `yaml:"provider"`
-		EnergyMetric      string `yaml:"energy_metric"`
-		PowerMetric       string `yaml:"power_metric"`
-		TemperatureMetric string `yaml:"temperature_metric"`
-		LightMetric       string `yaml:"light_metric"`
-		Address           string `yaml:"address"`
-		UserName          string `yaml:"user_name,omitempty"`
-		Password          string `yaml:"password,omitempty"`
-		useSSL            bool   `yaml:"ssl,omitempty"`
-		Interval          string `yaml:"interval"`
-		Devices           []struct {
-			Name    string `yaml:"name"`
-			Room    string `yaml:"room"`
-			Address string `yaml:"address"`
-			HmName  string `yaml:"hm_name"`
+		Provider            string            `yaml:"provider"`
+		EnergyMetric        string            `yaml:"energy_metric"`
+		PowerMetric         string            `yaml:"power_metric"`
+		TemperatureMetric   string            `yaml:"temperature_metric"`
+		LightMetric         string            `yaml:"light_metric"`
+		SetpointMetric      string            `yaml:"setpoint_metric,omitempty"`
+		SetpointModeMetric  string            `yaml:"setpoint_mode_metric,omitempty"`
+		ValveMetric         string            `yaml:"valve_metric,omitempty"`
+		BoostMetric         string            `yaml:"boost_metric,omitempty"`
+		WindowMetric        string            `yaml:"window_metric,omitempty"`
+		HumidityMetric      string            `yaml:"humidity_metric,omitempty"`
+		VoltageMetric       string            `yaml:"voltage_metric,omitempty"`
+		CurrentMetric       string            `yaml:"current_metric,omitempty"`
+		PowerFactorMetric   string            `yaml:"power_factor_metric,omitempty"`
+		ApparentPowerMetric string            `yaml:"apparent_power_metric,omitempty"`
+		ReactivePowerMetric string            `yaml:"reactive_power_metric,omitempty"`
+		EnergyTodayMetric   string            `yaml:"energy_today_metric,omitempty"`
+		PressureMetric      string            `yaml:"pressure_metric,omitempty"`
+		Co2Metric           string            `yaml:"co2_metric,omitempty"`
+		Sensors             []string          `yaml:"sensors,omitempty"`
+		Address             string            `yaml:"address"`
+		UserName            string            `yaml:"user_name,omitempty"`
+		Password            string            `yaml:"password,omitempty"`
+		UseSSL              bool              `yaml:"ssl,omitempty"`
+		CaFile              string            `yaml:"ca_file,omitempty"`
+		InsecureSkipVerify  bool              `yaml:"insecure_skip_verify,omitempty"`
+		ServerName          string            `yaml:"server_name,omitempty"`
+		Interval            string            `yaml:"interval"`
+		StaleAfter          string            `yaml:"stale_after,omitempty"`
+		StalePolicy         string            `yaml:"stale_policy,omitempty"`
+		Labels              map[string]string `yaml:"labels,omitempty"`
+		Discover            bool              `yaml:"discover,omitempty"`
+		ServiceMetrics      bool              `yaml:"service_metrics,omitempty"`
+		Include             []string          `yaml:"include,omitempty"`
+		Exclude             []string          `yaml:"exclude,omitempty"`
+		Sysvars             *SysvarSelection  `yaml:"sysvars,omitempty"`
+		Push                bool              `yaml:"push,omitempty"`
+		Devices             []struct {
+			Name     string            `yaml:"name"`
+			Room     string            `yaml:"room"`
+			Address  string            `yaml:"address"`
+			HmName   string            `yaml:"hm_name"`
+			Labels   map[string]string `yaml:"labels,omitempty"`
+			Channels string            `yaml:"channels,omitempty"`
 		} `yaml:"devices"`
 	} `yaml:"source"`
 }
 
+// CategoryMetrics maps the categories of a source to the configured metric
+// names. The metric of a category is defined by the key "<category>_metric".
+// Categories without a metric name are left out.
+func (d *Device) CategoryMetrics() map[string]string {
+	metrics := map[string]string{
+		"energy":      d.Source.EnergyMetric,
+		"power":       d.Source.PowerMetric,
+		"temperature": d.Source.TemperatureMetric,
+		"light":       d.Source.LightMetric,
+
+		// heating control of Homematic thermostats
+		"setpoint":      d.Source.SetpointMetric,
+		"setpoint_mode": d.Source.SetpointModeMetric,
+		"valve":         d.Source.ValveMetric,
+		"boost":         d.Source.BoostMetric,
+		"window":        d.Source.WindowMetric,
+		"humidity":      d.Source.HumidityMetric,
+
+		// electrical readings of Tasmota plugs
+		"voltage":        d.Source.VoltageMetric,
+		"current":        d.Source.CurrentMetric,
+		"power_factor":   d.Source.PowerFactorMetric,
+		"apparent_power": d.Source.ApparentPowerMetric,
+		"reactive_power": d.Source.ReactivePowerMetric,
+		"energy_today":   d.Source.EnergyTodayMetric,
+
+		// sensors attached to Tasmota devices
+		"pressure": d.Source.PressureMetric,
+		"co2":      d.Source.Co2Metric,
+	}
+
+	for k, v := range metrics {
+		if v == "" {
+			delete(metrics, k)
+		}
+	}
+
+	return metrics
+}
+
 type DeviceInterface interface {
 	DeviceID() string
 	MetricName() string
@@ -65,14 +139,185 @@ type DeviceInterface interface {
 	Room() string
 	FullName() string
 	LogName() string
+	LabelNames() []string
 	Labels() []string
 	CategoryName() string
+	ProviderName() string
+	Endpoint() string
 	IntervalSec() uint64
+	Stale() Staleness
 
 	CurrentValue(Context) (float64, error)
 	LastValue() string
 }
 
+// BatchReader is implemented by devices, which can be read together with
+// other devices of the same batch key in a single request.
+type BatchReader interface {
+	BatchKey() string
+
+	// ReadBatch reads all devices of the batch, which must share the batch
+	// key. It returns a value and an error for each device.
+	ReadBatch(ctx Context, batch []DeviceInterface) ([]float64, []error)
+}
+
+// Enumeration is implemented by devices, whose values may be indices into a
+// list of names. The name of the current value is exported as an info
+// metric.
+type Enumeration interface {
+	// ValueName returns the name of a value and false, if the values of the
+	// device have no names.
+	ValueName(value float64) (string, bool)
+}
+
+// Datapoint is implemented by devices, which can tell where their value is
+// read from, e.g. the channel and datapoint of a Homematic device.
+type Datapoint interface {
+	Datapoint() string
+}
+
+// lastText holds the formatted last value of a device. It is written by the
+// goroutine reading the device and read by the overview.
+type lastText struct {
+	text atomic.Value
+}
+
+func (l *lastText) setLastValue(text string) {
+	l.text.Store(text)
+}
+
+func (l *lastText) LastValue() string {
+	if text, ok := l.text.Load().(string); ok {
+		return text
+	}
+
+	return ""
+}
+
+const (
+	StaleDrop = "drop"
+	StaleNaN  = "nan"
+)
+
+// Staleness describes how long the last value of a device remains valid
+// when the device cannot be read. A zero After keeps the value forever.
+type Staleness struct {
+	After  time.Duration
+	Policy string
+}
+
+type staleConfig struct {
+	stale Staleness
+}
+
+func (s *staleConfig) Stale() Staleness {
+	return s.stale
+}
+
+func parseStaleness(device Device) (Staleness, error) {
+	stale := Staleness{Policy: StaleDrop}
+
+	if device.Source.StaleAfter != "" {
+		after, err := time.ParseDuration(device.Source.StaleAfter)
+
+		if err != nil {
+			return stale, err
+		}
+
+		stale.After = after
+	}
+
+	switch device.Source.StalePolicy {
+	case "", StaleDrop:
+	case StaleNaN:
+		stale.Policy = StaleNaN
+	default:
+		return stale, fmt.Errorf("unknown stale policy '%s'", device.Source.StalePolicy)
+	}
+
+	return stale, nil
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are used by home2grafana itself and cannot be defined by
+// the user.
+var reservedLabels = map[string]bool{
+	"provider": true,
+	"name":     true,
+	"room":     true,
+	"metric":   true,
+	"kind":     true,
+	"value":    true,
+	"channel":  true,
+	"phase":    true,
+	"sensor":   true,
+}
+
+// labelSet holds the user-defined labels of a device, sorted by name.
+type labelSet struct {
+	names  []string
+	values []string
+}
+
+// newLabelSet merges the labels of a source with the labels of a device.
+// The labels of the device take precedence.
+func newLabelSet(source map[string]string, device map[string]string) (labelSet, error) {
+	merged := make(map[string]string)
+
+	for k, v := range source {
+		merged[k] = v
+	}
+
+	for k, v := range device {
+		merged[k] = v
+	}
+
+	labels := labelSet{}
+
+	for k := range merged {
+		if !labelNameRE.MatchString(k) || strings.HasPrefix(k, "__") {
+			return labels, fmt.Errorf("invalid label name '%s'", k)
+		}
+
+		if reservedLabels[k] {
+			return labels, fmt.Errorf("label name '%s' is reserved", k)
+		}
+
+		labels.names = append(labels.names, k)
+	}
+
+	sort.Strings(labels.names)
+
+	for _, k := range labels.names {
+		labels.values = append(labels.values, merged[k])
+	}
+
+	return labels, nil
+}
+
+// with returns a copy of the labels with an additional label, which is set
+// by home2grafana itself and therefore may use a reserved name.
+func (l labelSet) with(name string, value string) labelSet {
+	i := sort.SearchStrings(l.names, name)
+	labels := labelSet{
+		names:  make([]string, 0, len(l.names)+1),
+		values: make([]string, 0, len(l.values)+1),
+	}
+
+	labels.names = append(append(append(labels.names, l.names[:i]...), name), l.names[i:]...)
+	labels.values = append(append(append(labels.values, l.values[:i]...), value), l.values[i:]...)
+	return labels
+}
+
+func (l *labelSet) LabelNames() []string {
+	return append([]string{"provider", "name", "room"}, l.names...)
+}
+
+func (l *labelSet) withLabels(provider string, name string, room string) []string {
+	return append([]string{provider, name, room}, l.values...)
+}
+
 type DeviceList struct {
 	Devices *[]DeviceInterface
 }
@@ -80,6 +325,54 @@ type DeviceList struct {
 type Devices struct {
 	DeviceList
 	ByDID map[string]DeviceList
+	files map[string]loadedFile
+
+	// incomplete is set, if a device or CCU could not be asked while
+	// loading, e.g. because it was offline.
+	incomplete bool
+
+	// retry is set, if no device of the setup notices, that the setup can
+	// be loaded completely, e.g. after the discovery of a CCU failed.
+	retry bool
+}
+
+// Incomplete checks whether some devices could not be loaded completely,
+// because a device or CCU was not available.
+func (d *Devices) Incomplete() bool {
+	return d.incomplete
+}
+
+// NeedsRetry checks whether the setup has to be loaded again periodically,
+// because no device requests it, once it can be loaded completely.
+func (d *Devices) NeedsRetry() bool {
+	return d.retry
+}
+
+// reloads receives the requests of devices to load the setup again.
+var reloads = make(chan string, 1)
+
+// ReloadRequests returns the channel, on which devices, which could not be
+// loaded completely, request to load the setup again once they answer. The
+// reason is sent.
+func ReloadRequests() <-chan string {
+	return reloads
+}
+
+// requestReload asks to load the setup again. A request is dropped, if a
+// request is already pending.
+func requestReload(reason string) {
+	select {
+	case reloads <- reason:
+	default:
+	}
+}
+
+// loadedFile remembers the devices defined by a file, so that an unchanged
+// file does not need to be loaded again. Only files, whose devices depend on
+// nothing but the file itself, are remembered.
+type loadedFile struct {
+	hash    [sha256.Size]byte
+	devices []DeviceInterface
 }
 
 func (d *Devices) addDevice(di DeviceInterface) {
@@ -108,13 +401,33 @@ func (d *Devices) Length() int {
 	return len(*d.Devices)
 }
 
-func LoadDevices(setup string) Devices {
+// LoadDevices walks the setup directory. The client is used for the
+// requests made while loading, e.g. discovering devices.
+func LoadDevices(setup string, client *http.Client) Devices {
+	devices, err := ReloadDevices(setup, nil, client)
+
+	if err != nil {
+		logrus.WithField("root", setup).WithError(err).Fatal("cannot walk device directory")
+	}
+
+	return devices
+}
+
+// ReloadDevices walks the setup directory again. Devices from files, which
+// have not changed since the previous load, are reused as they are, unless
+// they depend on answers given at load time. Any error while loading a file
+// fails the whole reload. Without a previous load, devices which cannot be
+// looked up are skipped, so that the others are exported.
+func ReloadDevices(setup string, previous *Devices, client *http.Client) (Devices, error) {
 	yamlRE := regexp.MustCompile(`\.yaml$`)
 
 	ctx := Context{
 		Root:      setup,
-		NetClient: &http.Client{Timeout: time.Second * 10},
+		NetClient: client,
 		Clog:      logrus.WithField("task", "load devices"),
+
+		skipFailed: previous == nil,
+		previous:   previous,
 	}
 
 	ctx.PushField("root", ctx.Root)
@@ -123,6 +436,7 @@ func LoadDevices(setup string) Devices {
 	devices := Devices{}
 	devices.Devices = new([]DeviceInterface)
 	devices.ByDID = make(map[string]DeviceList)
+	devices.files = make(map[string]loadedFile)
 
 	err := filepath.Walk(ctx.Root,
 		func(path string, info os.FileInfo, err error) error {
@@ -130,12 +444,11 @@ func LoadDevices(setup string) Devices {
 				return err
 			}
 
-			if !info.IsDir() && yamlRE.MatchString(info.Name()) && info.Name() != "overview.yaml" {
+			if !info.IsDir() && yamlRE.MatchString(info.Name()) &&
+				info.Name() != "overview.yaml" && info.Name() != HomematicProfilesFile {
 				ctx.PushField("filepath", path)
 				defer ctx.Pop()
 
-				ctx.Info("loading device file")
-
 				yfile, err := ioutil.ReadFile(path)
 
 				if err != nil {
@@ -143,37 +456,68 @@ func LoadDevices(setup string) Devices {
 					return nil
 				}
 
+				hash := sha256.Sum256(yfile)
+
+				if previous != nil {
+					if loaded, ok := previous.files[path]; ok && loaded.hash == hash {
+						for _, di := range loaded.devices {
+							devices.addDevice(di)
+						}
+
+						devices.files[path] = loaded
+						return nil
+					}
+				}
+
+				ctx.Info("loading device file")
+
 				device := Device{}
 				err = yaml.Unmarshal(yfile, &device)
 
 				if err != nil {
 					ctx.Warn(err, "cannot parse file")
-					return err
+					return fmt.Errorf("%s: %w", path, err)
 				}
 
 				provider := device.Source.Provider
 				ctx.PushField("provider", provider)
 				defer ctx.Pop()
 
+				first := devices.Length()
+
 				switch {
 				case provider == "tasmota":
-					return LoadTasmotaDevices(ctx, &devices, device)
+					err = LoadTasmotaDevices(ctx, &devices, device)
 				case provider == "homematic":
-					return LoadHomematicDevices(ctx, &devices, device)
+					err = LoadHomematicDevices(ctx, &devices, device)
+				case provider == "homematic-jsonrpc":
+					err = LoadHomematicRpcDevices(ctx, &devices, device)
+				case provider == "homematic-xmlapi":
+					err = LoadHomematicXmlApiDevices(ctx, &devices, device)
 				case provider == "iobroker":
-					return LoadIoBrokerDevices(ctx, &devices, device)
+					err = LoadIoBrokerDevices(ctx, &devices, device)
 				default:
 					ctx.Clog.Warn("unkown provider")
+				}
+
+				if err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+
+				// the devices of the other providers depend on the profiles,
+				// the certificates and the answers of the devices at load
+				// time, e.g. discovered devices, channels and sensors
+				if provider != "iobroker" {
 					return nil
 				}
+
+				loaded := loadedFile{hash: hash}
+				loaded.devices = append(loaded.devices, (*devices.Devices)[first:]...)
+				devices.files[path] = loaded
 			}
 
 			return nil
 		})
 
-	if err != nil {
-		ctx.Fatal(err, "cannot walk device directory")
-	}
-
-	return devices
+	return devices, err
 }
@@ -0,0 +1,107 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// StatusError is returned when a device answers with an unexpected HTTP
+// status code.
+type StatusError struct {
+	Url        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request to %s failed with status %d", e.Url, e.StatusCode)
+}
+
+// ParseError is returned when the answer of a device cannot be parsed.
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse response: %v", e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// HomematicErrorKind classifies the errors returned by a CCU.
+type HomematicErrorKind string
+
+const (
+	// HomematicAuth means the CCU has rejected the credentials.
+	HomematicAuth HomematicErrorKind = "auth"
+
+	// HomematicUnavailable means the CCU cannot be reached or is not ready,
+	// e.g. while it reboots.
+	HomematicUnavailable HomematicErrorKind = "unavailable"
+
+	// HomematicScript means the CCU could not run a script or call.
+	HomematicScript HomematicErrorKind = "script"
+
+	// HomematicUnknownObject means the CCU does not know a device or a
+	// datapoint.
+	HomematicUnknownObject HomematicErrorKind = "unknown_object"
+)
+
+// HomematicError is returned by all Homematic providers.
+type HomematicError struct {
+	Kind HomematicErrorKind
+	Err  error
+}
+
+func (e *HomematicError) Error() string {
+	return fmt.Sprintf("homematic %s: %v", e.Kind, e.Err)
+}
+
+func (e *HomematicError) Unwrap() error {
+	return e.Err
+}
+
+// homematicStatusError classifies an unexpected HTTP status of a CCU.
+func homematicStatusError(url string, statusCode int) error {
+	kind := HomematicUnavailable
+
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		kind = HomematicAuth
+	}
+
+	return &HomematicError{Kind: kind, Err: &StatusError{Url: url, StatusCode: statusCode}}
+}
+
+// IsAuthError checks whether an error has been caused by rejected
+// credentials. Retrying will not help until the setup has been changed.
+func IsAuthError(err error) bool {
+	var hmErr *HomematicError
+	return errors.As(err, &hmErr) && hmErr.Kind == HomematicAuth
+}
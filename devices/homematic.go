@@ -27,55 +27,100 @@ package devices
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"golang.org/x/text/encoding/charmap"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type HomematicDesc struct {
-	HmName             string
-	Name               string
-	Room               string
-	Interval           float64
-	ScriptUrl          string
-	UserName           string
-	Password           string
-	EnergyMetric       string
-	EnergyChannel      int
-	PowerMetric        string
-	PowerChannel       int
-	TemperatureMetric  string
-	TemperatureChannel int
-	TemperatureName    string
-	LightMetric        string
-	LightChannel       int
-	LightName          string
+	Provider string
+	HmName   string
+	HssType  string
+	Name     string
+	Room     string
+	Interval float64
+	Stale    Staleness
+	Labels   labelSet
+	Metrics  map[string]string
+	Profiles HomematicProfiles
+	Backend  homematicBackend
+	Push     *homematicPushSource
+
+	// Info holds the device as listed by the CCU, if it has been
+	// discovered. Otherwise the device is looked up.
+	Info *homematicDeviceInfo
+
+	// Discovered devices are only created, if they match the include and
+	// do not match the exclude patterns.
+	Discovered bool
+	Include    []string
+	Exclude    []string
+}
+
+// matches checks whether one of the patterns matches the hm_name, name or
+// room of a device.
+func (d *HomematicDesc) matches(patterns []string) bool {
+	for _, pattern := range patterns {
+		for _, value := range []string{d.HmName, d.Name, d.Room} {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// selected checks whether the devices of a discovered device should be
+// created. Devices listed explicitly are always selected.
+func (d *HomematicDesc) selected() bool {
+	if !d.Discovered {
+		return true
+	}
+
+	if len(d.Include) > 0 && !d.matches(d.Include) {
+		return false
+	}
+
+	return !d.matches(d.Exclude)
 }
 
 type HomematicDevice struct {
+	provider  string
+	backend   homematicBackend
 	metric    string
 	name      string
 	room      string
 	hmName    string
+	hssType   string
 	interval  float64
-	scriptUrl string
-	userName  string
-	password  string
 	category  string
 	dpChannel int
 	dpName    string
-	lastValue string
+	unit      string
+	scale     float64
+	sysvar    *homematicSysvar
+	push      *homematicPushSource
+	lastText
+	staleConfig
+	labelSet
 }
 
 func (t *HomematicDevice) DeviceID() string {
-	return fmt.Sprintf("homematic: %s", t.hmName)
+	return fmt.Sprintf("%s: %s", t.provider, t.hmName)
 }
 
 func (t *HomematicDevice) Name() string {
@@ -88,8 +133,9 @@ func (t *HomematicDevice) Room() string {
 
 func (t *HomematicDevice) FullName() string {
 	return fmt.Sprintf(
-		"%s[provider:homematic,hm:%s,name:%s,room:%s,interval:%v]",
+		"%s[provider:%s,hm:%s,name:%s,room:%s,interval:%v]",
 		t.metric,
+		t.provider,
 		t.hmName,
 		t.name,
 		t.room,
@@ -102,7 +148,15 @@ func (t *HomematicDevice) LogName() string {
 }
 
 func (t *HomematicDevice) Labels() []string {
-	return []string{"homematic", t.name, t.room}
+	return t.withLabels(t.provider, t.name, t.room)
+}
+
+func (t *HomematicDevice) ProviderName() string {
+	return t.provider
+}
+
+func (t *HomematicDevice) Endpoint() string {
+	return t.backend.endpoint()
 }
 
 func (t *HomematicDevice) IntervalSec() uint64 {
@@ -118,11 +172,176 @@ func (t *HomematicDevice) CategoryName() string {
 }
 
 func (t *HomematicDevice) CurrentValue(ctx Context) (float64, error) {
-	return getValue(ctx, t)
+	values, errs := t.ReadBatch(ctx, []DeviceInterface{t})
+	return values[0], errs[0]
+}
+
+func (t *HomematicDevice) BatchKey() string {
+	return t.provider + "|" + t.backend.endpoint()
+}
+
+func (t *HomematicDevice) ReadBatch(ctx Context, batch []DeviceInterface) ([]float64, []error) {
+	return t.backend.readValues(ctx, batch)
 }
 
-func (t *HomematicDevice) LastValue() string {
-	return t.lastValue
+// setValue scales a value read from the CCU and stores its text.
+func (t *HomematicDevice) setValue(value float64) float64 {
+	if t.sysvar != nil {
+		t.setLastValue(t.sysvar.text(value))
+		return value
+	}
+
+	if t.scale != 0 {
+		value *= t.scale
+	}
+
+	t.setLastValue(formatHomematicValue(t.category, t.unit, value))
+	return value
+}
+
+// parseValue converts a value read from the CCU and stores it. found is
+// false, if the CCU returned no value.
+func (t *HomematicDevice) parseValue(raw interface{}, found bool) (float64, error) {
+	if !found {
+		return 0, &HomematicError{Kind: HomematicUnknownObject, Err: fmt.Errorf("no value for %s", t.datapoint())}
+	}
+
+	value, err := parseHomematicValue(raw)
+
+	if err != nil {
+		return 0, &ParseError{Err: err}
+	}
+
+	return t.setValue(value), nil
+}
+
+// datapoint returns the datapoint or system variable read by the device.
+func (t *HomematicDevice) datapoint() string {
+	if t.sysvar != nil {
+		return "system variable " + t.sysvar.name
+	}
+
+	return fmt.Sprintf("datapoint %s:%d.%s", t.hmName, t.dpChannel, t.dpName)
+}
+
+func (t *HomematicDevice) Datapoint() string {
+	if t.sysvar != nil {
+		return "system variable " + t.sysvar.name
+	}
+
+	return fmt.Sprintf("%s:%d.%s (%s)", t.hmName, t.dpChannel, t.dpName, t.hssType)
+}
+
+// homematicDeviceInfo is a device listed by the CCU. Discovered devices are
+// created from it, without looking up each device again.
+type homematicDeviceInfo struct {
+	hmName   string
+	hssType  string
+	channels map[int]homematicChannelInfo
+}
+
+type homematicChannelInfo struct {
+	name string
+	room string
+}
+
+// channelIndex returns the index of a channel address like
+// "0001DD89971DDD:6".
+func channelIndex(address string) (int, bool) {
+	i := strings.LastIndex(address, ":")
+
+	if i < 0 {
+		return 0, false
+	}
+
+	index, err := strconv.Atoi(address[i+1:])
+	return index, err == nil
+}
+
+// homematicBackend hides the API used to access a CCU.
+type homematicBackend interface {
+	// endpoint returns the url of the API.
+	endpoint() string
+
+	// listDevices returns all devices known to the CCU including their
+	// HssType and the names and rooms of their channels.
+	listDevices(ctx Context) ([]homematicDeviceInfo, error)
+
+	// readType returns the HssType of a device.
+	readType(ctx Context, hmName string) (string, error)
+
+	// readChannel returns the name and room of the channel holding a
+	// datapoint.
+	readChannel(ctx Context, hmName string, channel int, datapoint string) (string, string, error)
+
+	// readValues reads the datapoints of all devices of a batch. It returns
+	// a value and an error for each device.
+	readValues(ctx Context, batch []DeviceInterface) ([]float64, []error)
+
+	// listSysvars returns all system variables of the CCU.
+	listSysvars(ctx Context) ([]homematicSysvar, error)
+}
+
+// newHomematicTransport creates the transport for the TLS settings of a
+// source. It returns nil, if the default settings are used. A relative
+// ca_file is taken relative to the setup directory.
+func newHomematicTransport(setup string, device Device) (http.RoundTripper, error) {
+	if device.Source.CaFile == "" && !device.Source.InsecureSkipVerify && device.Source.ServerName == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: device.Source.InsecureSkipVerify,
+		ServerName:         device.Source.ServerName,
+	}
+
+	if device.Source.CaFile != "" {
+		caFile := device.Source.CaFile
+
+		if !filepath.IsAbs(caFile) {
+			caFile = filepath.Join(setup, caFile)
+		}
+
+		pem, err := ioutil.ReadFile(caFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	return transport, nil
+}
+
+// homematicClient returns the client for requests to a CCU. It shares the
+// timeout of the client of the context, but uses the transport of the
+// source, if given.
+func homematicClient(ctx Context, transport http.RoundTripper) *http.Client {
+	if transport == nil {
+		return ctx.NetClient
+	}
+
+	return &http.Client{Timeout: ctx.NetClient.Timeout, Transport: transport}
+}
+
+// homematicScript accesses a CCU by running ReGa scripts.
+type homematicScript struct {
+	url       string
+	userName  string
+	password  string
+	transport http.RoundTripper
+}
+
+func (h *homematicScript) endpoint() string {
+	return h.url
 }
 
 type homematicXml struct {
@@ -140,323 +359,574 @@ type homematicXml struct {
 	Value         string   `xml:"value"`
 }
 
-func readHomematicXml(
-	ctx Context, scriptUrl string, userName string, password string, cmd string, result *homematicXml) error {
+// homematicValuesXml holds all variables of a script, which are returned
+// by the CCU as elements named after the variable.
+type homematicValuesXml struct {
+	XmlName xml.Name `xml:"xml"`
+	Values  []struct {
+		XMLName xml.Name
+		Text    string `xml:",chardata"`
+	} `xml:",any"`
+}
 
-	req, err := http.NewRequest("POST", scriptUrl, bytes.NewBufferString(cmd))
+// readXml runs a script and parses the variables returned.
+func (h *homematicScript) readXml(ctx Context, cmd string, result interface{}) error {
+	req, err := http.NewRequest("POST", h.url, bytes.NewBufferString(cmd))
 	if err != nil {
 		return err
 	}
 
-	req.SetBasicAuth(userName, password)
-	cli := &http.Client{}
-	response, err := cli.Do(req)
+	req.SetBasicAuth(h.userName, h.password)
+	response, err := homematicClient(ctx, h.transport).Do(req)
 
 	if err != nil {
-		return err
+		return &HomematicError{Kind: HomematicUnavailable, Err: err}
 	}
 
 	body, err := io.ReadAll(charmap.ISO8859_1.NewDecoder().Reader(response.Body))
 	defer response.Body.Close()
 
-	if response.StatusCode != 200 {
-		ctx.Clog.Fatalf("request failed: Response code %d ", string(body))
+	if response.StatusCode != http.StatusOK {
+		return homematicStatusError(h.url, response.StatusCode)
 	}
 
-	if err = parseXml(ctx, body, &result); err != nil {
-		return err
+	if err != nil {
+		return &HomematicError{Kind: HomematicUnavailable, Err: err}
+	}
+
+	if err = parseXml(ctx, body, result); err != nil {
+		return &HomematicError{Kind: HomematicScript, Err: &ParseError{Err: err}}
 	}
 
 	return nil
 }
 
-func getValue(ctx Context, t *HomematicDevice) (float64, error) {
-	valueCmd := fmt.Sprintf(
-		`var value = dom.GetObject('%s:%d.%s').State();`, t.hmName, t.dpChannel, t.dpName)
+// readValues reads the datapoints of all devices of a batch with a single
+// script. The value of the i-th device is returned in the variable "v<i>".
+func (h *homematicScript) readValues(ctx Context, batch []DeviceInterface) ([]float64, []error) {
+	values := make([]float64, len(batch))
+	errs := make([]error, len(batch))
+	cmd := bytes.NewBufferString("var o;\n")
 
-	info := homematicXml{}
-	err1 := readHomematicXml(ctx, t.scriptUrl, t.userName, t.password, valueCmd, &info)
+	for i, d := range batch {
+		hm := d.(*HomematicDevice)
+
+		if hm.sysvar != nil {
+			fmt.Fprintf(cmd, "var v%d = \"null\"; o = dom.GetObject(ID_SYSTEM_VARIABLES).Get('%s'); if (o) { v%d = o.Value(); }\n",
+				i, regaString(hm.sysvar.name), i)
+			continue
+		}
+
+		fmt.Fprintf(cmd, "var v%d = \"null\"; o = dom.GetObject('%s:%d.%s'); if (o) { v%d = o.State(); }\n",
+			i, hm.hmName, hm.dpChannel, hm.dpName, i)
+	}
+
+	info := homematicValuesXml{}
+	err1 := h.readXml(ctx, cmd.String(), &info)
 
 	if err1 != nil {
-		return 0, err1
+		for i := range errs {
+			errs[i] = err1
+		}
+
+		return values, errs
 	}
 
-	value, err2 := strconv.ParseFloat(info.Value, 64)
+	found := make(map[string]string, len(info.Values))
 
-	if err2 != nil {
-		return 0, err2
-	}
-
-	switch t.category {
-	case "temperature":
-		t.lastValue = fmt.Sprintf("%.2f °C", value)
-	case "power":
-		t.lastValue = fmt.Sprintf("%.2f W/h", value)
-	case "energy":
-		t.lastValue = fmt.Sprintf("%.2f kW/h", value/1000)
-	case "light":
-		t.lastValue = fmt.Sprintf("%.2f", value)
+	for _, v := range info.Values {
+		found[v.XMLName.Local] = v.Text
+	}
+
+	for i, d := range batch {
+		hm := d.(*HomematicDevice)
+		text, ok := found[fmt.Sprintf("v%d", i)]
+		values[i], errs[i] = hm.parseValue(text, ok && text != "null")
+	}
+
+	return values, errs
+}
+
+// parseHomematicValue converts the value of a datapoint. Depending on the
+// API and the firmware, numbers and booleans are returned as strings or as
+// numbers and booleans. Booleans are converted to 1 and 0.
+func parseHomematicValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+
+		return 0, nil
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return parseHomematicValue(b)
+		}
+
+		return strconv.ParseFloat(v, 64)
 	default:
-		t.lastValue = fmt.Sprintf("%.2f %s", value, t.category)
+		return 0, fmt.Errorf("unexpected value %v", value)
+	}
+}
+
+func formatHomematicValue(category string, unit string, value float64) string {
+	if category == "energy" {
+		return fmt.Sprintf("%.2f kW/h", value/1000)
+	}
+
+	if unit == "" {
+		return fmt.Sprintf("%.2f", value)
 	}
 
-	return value, nil
+	return fmt.Sprintf("%.2f %s", value, unit)
 }
 
-func readHmDevice(ctx Context, channel int, name string, homematic *HomematicDesc) error {
+func (h *homematicScript) readChannel(ctx Context, hmName string, channel int, datapoint string) (string, string, error) {
 	roomCmd := fmt.Sprintf(
 		`var channelId = dom.GetObject('%s:%d.%s').Channel();
 		var channel = dom.GetObject(channelId);
 		var name = channel.Name();
 		var roomId = channel.ChnRoom();
 		var room = dom.GetObject(roomId);
-	`, homematic.HmName, channel, name)
+	`, hmName, channel, datapoint)
 
 	info := homematicXml{}
-	err1 := readHomematicXml(ctx, homematic.ScriptUrl, homematic.UserName, homematic.Password, roomCmd, &info)
+	err1 := h.readXml(ctx, roomCmd, &info)
 
 	if err1 != nil {
-		return err1
+		return "", "", err1
 	}
 
-	if len(homematic.Name) == 0 && len(info.Name) > 0 {
-		homematic.Name = info.Name
-	}
+	return info.Name, info.Room, nil
+}
 
-	if len(homematic.Room) == 0 && len(info.Room) > 0 {
-		homematic.Room = info.Room
+// listDevices lists all devices with a single script. Each device is
+// returned as a line "D<tab>hm_name<tab>HssType", followed by a line
+// "C<tab>address<tab>name<tab>room" for each of its channels.
+func (h *homematicScript) listDevices(ctx Context) ([]homematicDeviceInfo, error) {
+	listCmd := `var devices = "";
+		string id;
+		string chId;
+		foreach (id, root.Devices().EnumUsedIDs()) {
+			var device = dom.GetObject(id);
+			var iface = dom.GetObject(device.Interface());
+			if (iface) {
+				devices = devices # "D\t" # iface.Name() # "." # device.Address() # "\t" # device.HssType() # "\n";
+				foreach (chId, device.Channels().EnumUsedIDs()) {
+					var channel = dom.GetObject(chId);
+					var room = "";
+					var roomObj = dom.GetObject(channel.ChnRoom());
+					if (roomObj) {
+						room = roomObj.Name();
+					}
+					devices = devices # "C\t" # channel.Address() # "\t" # channel.Name() # "\t" # room # "\n";
+				}
+			}
+		}`
+
+	info := homematicValuesXml{}
+	err1 := h.readXml(ctx, listCmd, &info)
+
+	if err1 != nil {
+		return nil, err1
 	}
 
-	ctx.PushFields(logrus.Fields{"name": homematic.Name, "room": homematic.Room})
-	ctx.Info("found device")
-	ctx.Pop()
+	devices := make([]homematicDeviceInfo, 0)
 
-	return nil
+	for _, v := range info.Values {
+		if v.XMLName.Local != "devices" {
+			continue
+		}
+
+		for _, line := range strings.Split(v.Text, "\n") {
+			fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+
+			switch {
+			case fields[0] == "D" && len(fields) >= 3:
+				devices = append(devices, homematicDeviceInfo{
+					hmName:   fields[1],
+					hssType:  fields[2],
+					channels: make(map[int]homematicChannelInfo),
+				})
+			case fields[0] == "C" && len(fields) >= 4 && len(devices) > 0:
+				if index, ok := channelIndex(fields[1]); ok {
+					devices[len(devices)-1].channels[index] = homematicChannelInfo{name: fields[2], room: fields[3]}
+				}
+			}
+		}
+	}
+
+	return devices, nil
 }
 
-func generateHmDevice(ctx Context, devices *Devices, desc *HomematicDesc) error {
-	var err error
+func (h *homematicScript) readType(ctx Context, hmName string) (string, error) {
+	typeCmd := fmt.Sprintf(
+		`var channel = dom.GetObject('%s:0.UNREACH').Channel();
+		var device = dom.GetObject(dom.GetObject(channel).Device());
+		var hssType = device.HssType();
+		var interface = dom.GetObject(device.Interface());`, hmName)
+
+	info := homematicXml{}
+	err1 := h.readXml(ctx, typeCmd, &info)
 
-	if desc.EnergyMetric != "" {
-		err = readHmDevice(ctx, desc.EnergyChannel, "ENERGY_COUNTER", desc)
-	} else if desc.TemperatureMetric != "" {
-		err = readHmDevice(ctx, desc.TemperatureChannel, desc.TemperatureName, desc)
-	} else if desc.LightMetric != "" {
-		err = readHmDevice(ctx, desc.LightChannel, desc.LightName, desc)
+	if err1 != nil {
+		return "", err1
 	}
 
-	if err != nil {
-		return err
+	if info.Channel == "null" {
+		return "", &HomematicError{Kind: HomematicUnknownObject, Err: errors.New("unknown desc device: " + hmName)}
 	}
 
-	if desc.EnergyMetric != "" {
-		energy := HomematicDevice{
-			name:      desc.Name,
-			room:      desc.Room,
-			hmName:    desc.HmName,
-			interval:  desc.Interval,
-			scriptUrl: desc.ScriptUrl,
-			metric:    desc.EnergyMetric,
-			category:  "energy",
-			dpChannel: desc.EnergyChannel,
-			dpName:    "ENERGY_COUNTER",
+	return info.HssType, nil
+}
+
+func readHmDevice(ctx Context, channel int, datapoint string, homematic *HomematicDesc) error {
+	var name, room string
+
+	if homematic.Info != nil {
+		name = homematic.Info.channels[channel].name
+		room = homematic.Info.channels[channel].room
+	} else {
+		var err1 error
+		name, room, err1 = homematic.Backend.readChannel(ctx, homematic.HmName, channel, datapoint)
+
+		if err1 != nil {
+			return err1
 		}
+	}
 
-		devices.addDevice(&energy)
+	if len(homematic.Name) == 0 && len(name) > 0 {
+		homematic.Name = name
 	}
 
-	if desc.PowerMetric != "" {
-		power := HomematicDevice{
-			name:      desc.Name,
-			room:      desc.Room,
-			hmName:    desc.HmName,
-			interval:  desc.Interval,
-			scriptUrl: desc.ScriptUrl,
-			metric:    desc.PowerMetric,
-			category:  "power",
-			dpChannel: desc.EnergyChannel,
-			dpName:    "POWER",
+	if len(homematic.Room) == 0 && len(room) > 0 {
+		homematic.Room = room
+	}
+
+	ctx.PushFields(logrus.Fields{"name": homematic.Name, "room": homematic.Room})
+	ctx.Info("found device")
+	ctx.Pop()
+
+	return nil
+}
+
+// generateHmDevice creates a device for each datapoint of the profile, for
+// which the source defines a metric. The name and room are taken from the
+// channel of the first such datapoint.
+func generateHmDevice(ctx Context, devices *Devices, desc *HomematicDesc, datapoints []HomematicDatapoint) error {
+	used := make([]HomematicDatapoint, 0, len(datapoints))
+
+	for _, dp := range datapoints {
+		if desc.Metrics[dp.Category] != "" {
+			used = append(used, dp)
 		}
+	}
 
-		devices.addDevice(&power)
+	if len(used) == 0 {
+		return nil
 	}
 
-	if desc.TemperatureMetric != "" {
-		temperature := HomematicDevice{
-			name:      desc.Name,
-			room:      desc.Room,
-			hmName:    desc.HmName,
-			interval:  desc.Interval,
-			scriptUrl: desc.ScriptUrl,
-			metric:    desc.TemperatureMetric,
-			category:  "temperature",
-			dpChannel: desc.TemperatureChannel,
-			dpName:    desc.TemperatureName,
+	// take the name from the channel of the first measured value, service
+	// datapoints are held by the maintenance channel
+	named := used[0]
+
+	for _, dp := range datapoints {
+		if _, ok := homematicServiceMetrics[dp.Category]; !ok {
+			named = dp
+			break
 		}
+	}
+
+	if err := readHmDevice(ctx, named.Channel, named.Datapoint, desc); err != nil {
+		return err
+	}
 
-		devices.addDevice(&temperature)
+	if !desc.selected() {
+		ctx.Info("skipping excluded device")
+		return nil
 	}
 
-	if desc.LightMetric != "" {
-		light := HomematicDevice{
-			name:      desc.Name,
-			room:      desc.Room,
-			hmName:    desc.HmName,
-			interval:  desc.Interval,
-			scriptUrl: desc.ScriptUrl,
-			metric:    desc.LightMetric,
-			category:  "light",
-			dpChannel: desc.LightChannel,
-			dpName:    desc.LightName,
+	for _, dp := range used {
+		device := HomematicDevice{
+			provider:    desc.Provider,
+			backend:     desc.Backend,
+			name:        desc.Name,
+			room:        desc.Room,
+			hmName:      desc.HmName,
+			hssType:     desc.HssType,
+			interval:    desc.Interval,
+			staleConfig: staleConfig{desc.Stale},
+			labelSet:    desc.Labels,
+			metric:      desc.Metrics[dp.Category],
+			category:    dp.Category,
+			dpChannel:   dp.Channel,
+			dpName:      dp.Datapoint,
+			unit:        dp.Unit,
+			scale:       dp.Scale,
+			push:        desc.Push,
 		}
 
-		devices.addDevice(&light)
+		devices.addDevice(&device)
 	}
 
 	return nil
 }
 
 func generateHomematic(ctx Context, devices *Devices, desc *HomematicDesc) error {
-	typeCmd := fmt.Sprintf(
-		`var channel = dom.GetObject('%s:0.UNREACH').Channel();
-		var device = dom.GetObject(dom.GetObject(channel).Device());
-		var hssType = device.HssType();
-		var interface = dom.GetObject(device.Interface());`, desc.HmName)
-
-	info := homematicXml{}
-	err1 := readHomematicXml(ctx, desc.ScriptUrl, desc.UserName, desc.Password, typeCmd, &info)
+	var hssType string
 
-	if err1 != nil {
-		return err1
-	}
+	if desc.Info != nil {
+		hssType = desc.Info.hssType
+	} else {
+		var err1 error
+		hssType, err1 = desc.Backend.readType(ctx, desc.HmName)
 
-	if info.Channel == "null" {
-		return errors.New("unknown desc device: " + desc.HmName)
+		if err1 != nil {
+			return err1
+		}
 	}
 
-	hssType := info.HssType
 	ctx.PushFields(logrus.Fields{"HssType": hssType, "HmName": desc.HmName})
 	defer ctx.Pop()
 
-	switch {
-	case hssType == "HMIP-PSM":
-		desc.EnergyChannel = 6
-		desc.LightMetric = ""
-		desc.PowerChannel = 6
-		desc.TemperatureChannel = 0
-		desc.TemperatureName = "ACTUAL_TEMPERATURE"
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HM-ES-PMSw1-Pl":
-		desc.EnergyChannel = 2
-		desc.LightMetric = ""
-		desc.PowerChannel = 2
-		desc.TemperatureMetric = ""
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HM-ES-TX-WM":
-		desc.EnergyChannel = 1
-		desc.LightMetric = ""
-		desc.PowerChannel = 1
-		desc.TemperatureMetric = ""
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HmIP-WTH-2" || hssType == "HmIP-eTRV-B":
-		desc.EnergyMetric = ""
-		desc.LightMetric = ""
-		desc.PowerMetric = ""
-		desc.TemperatureChannel = 1
-		desc.TemperatureName = "ACTUAL_TEMPERATURE"
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HM-CC-RT-DN":
-		desc.EnergyMetric = ""
-		desc.LightMetric = ""
-		desc.PowerMetric = ""
-		desc.TemperatureChannel = 4
-		desc.TemperatureName = "ACTUAL_TEMPERATURE"
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HM-WDS10-TH-O" || hssType == "HM-WDS40-TH-I":
-		desc.EnergyMetric = ""
-		desc.LightMetric = ""
-		desc.PowerMetric = ""
-		desc.TemperatureChannel = 1
-		desc.TemperatureName = "TEMPERATURE"
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HmIP-SMI55":
-		desc.EnergyMetric = ""
-		desc.LightChannel = 3
-		desc.LightName = "CURRENT_ILLUMINATION"
-		desc.PowerMetric = ""
-		desc.TemperatureMetric = ""
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HmIP-SMI":
-		desc.EnergyMetric = ""
-		desc.LightChannel = 1
-		desc.LightName = "CURRENT_ILLUMINATION"
-		desc.PowerMetric = ""
-		desc.TemperatureMetric = ""
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HM-Sec-MDIR-2":
-		desc.EnergyMetric = ""
-		desc.LightChannel = 1
-		desc.LightName = "BRIGHTNESS"
-		desc.PowerMetric = ""
-		desc.TemperatureMetric = ""
-		return generateHmDevice(ctx, devices, desc)
-	case hssType == "HM-WDS100-C6-O":
-		desc.EnergyMetric = ""
-		desc.LightChannel = 1
-		desc.LightName = "BRIGHTNESS"
-		desc.PowerMetric = ""
-		desc.TemperatureChannel = 1
-		desc.TemperatureName = "TEMPERATURE"
-		return generateHmDevice(ctx, devices, desc)
-	default:
-		ctx.Clog.Warn("unknown HssType: ", hssType)
+	desc.HssType = hssType
+
+	datapoints, ok := desc.Profiles[hssType]
+
+	if !ok {
+		if desc.Discovered {
+			ctx.Info("skipping device without profile")
+		} else {
+			ctx.Clog.Warn("unknown HssType: ", hssType)
+		}
+
+		return nil
 	}
 
-	return nil
+	return generateHmDevice(ctx, devices, desc, datapoints)
 }
 
 func LoadHomematicDevices(ctx Context, devices *Devices, device Device) error {
+	var port string
+	var protocol = "http"
+	if device.Source.UseSSL {
+		port = "48181"
+		protocol += "s"
+	} else {
+		port = "8181"
+	}
+
+	transport, err := newHomematicTransport(ctx.Root, device)
+
+	if err != nil {
+		ctx.Warn(err, "cannot configure tls")
+		return err
+	}
+
+	backend := &homematicScript{
+		url:       fmt.Sprintf("%s://%s:%s/Test.exe", protocol, device.Source.Address, port),
+		userName:  device.Source.UserName,
+		password:  device.Source.Password,
+		transport: transport,
+	}
+
+	return loadHomematic(ctx, devices, device, backend)
+}
+
+// loadHomematic creates the devices of a Homematic source, which are read
+// using the backend.
+func loadHomematic(ctx Context, devices *Devices, device Device, backend homematicBackend) error {
 	duration, err1 := time.ParseDuration(device.Source.Interval)
 
 	if err1 != nil {
 		ctx.Warn(err1, "cannot parse duration")
-		return nil
+		return err1
 	}
 
 	if duration < 0 {
 		duration = 60
 	}
 
-	var port string
-	var protocol = "http"
-	if device.Source.useSSL {
-		port = "48181"
-		protocol += "s"
-	} else {
-		port = "8181"
+	stale, err2 := parseStaleness(device)
+
+	if err2 != nil {
+		ctx.Warn(err2, "cannot parse staleness")
+		return err2
+	}
+
+	profiles, err4 := LoadHomematicProfiles(ctx.Root)
+
+	if err4 != nil {
+		ctx.Warn(err4, "cannot load homematic profiles")
+		return err4
+	}
+
+	var push *homematicPushSource
+
+	if device.Source.Push {
+		transport, err7 := newHomematicTransport(ctx.Root, device)
+
+		if err7 != nil {
+			ctx.Warn(err7, "cannot configure tls")
+			return err7
+		}
+
+		push = newHomematicPushSource(device, transport)
 	}
 
-	scriptUrl := fmt.Sprintf("%s://%s:%s/Test.exe", protocol, device.Source.Address, port)
+	listed := make(map[string]bool)
 
 	for _, d := range device.Source.Devices {
+		listed[d.HmName] = true
+	}
+
+	metrics := device.CategoryMetrics()
+	sourceLabels, err6 := newLabelSet(device.Source.Labels, nil)
+
+	if err6 != nil {
+		ctx.Warn(err6, "cannot parse labels")
+		return err6
+	}
+
+	if device.Source.ServiceMetrics {
+		for category, metric := range homematicServiceMetrics {
+			metrics[category] = metric
+		}
+
+		if !listed[homematicReceiver] {
+			homematic := HomematicDesc{
+				Provider: device.Source.Provider,
+				Backend:  backend,
+				HmName:   homematicReceiver,
+				Name:     "CCU",
+				Interval: duration.Seconds(),
+				Stale:    stale,
+				Labels:   sourceLabels,
+				Metrics:  metrics,
+				Profiles: profiles,
+				Push:     push,
+			}
+
+			if err := generateHomematic(ctx, devices, &homematic); err != nil {
+				ctx.PushField("error", err)
+				ctx.Info("no duty cycle available")
+				ctx.Pop()
+			}
+
+			listed[homematicReceiver] = true
+		}
+	}
+
+	if device.Source.Discover {
+		infos, err5 := backend.listDevices(ctx)
+
+		if isHomematicTransient(err5) {
+			ctx.Warn(err5, "cannot discover homematic devices, trying again later")
+			devices.incomplete = true
+			devices.retry = true
+		} else if err5 != nil {
+			ctx.Warn(err5, "cannot discover homematic devices")
+			return err5
+		}
+
+		for i := range infos {
+			if listed[infos[i].hmName] {
+				continue
+			}
+
+			homematic := HomematicDesc{
+				Provider:   device.Source.Provider,
+				Backend:    backend,
+				HmName:     infos[i].hmName,
+				Info:       &infos[i],
+				Interval:   duration.Seconds(),
+				Stale:      stale,
+				Labels:     sourceLabels,
+				Metrics:    metrics,
+				Profiles:   profiles,
+				Push:       push,
+				Discovered: true,
+				Include:    device.Source.Include,
+				Exclude:    device.Source.Exclude,
+			}
+
+			err := generateHomematic(ctx, devices, &homematic)
+
+			if err != nil && ctx.skipFailed {
+				ctx.Warn(err, "cannot load homematic device data, skipping the device")
+				continue
+			}
+
+			if err != nil {
+				ctx.Warn(err, "cannot load homematic device data")
+				return err
+			}
+		}
+	}
+
+	for _, d := range device.Source.Devices {
+		labels, err3 := newLabelSet(device.Source.Labels, d.Labels)
+
+		if err3 != nil {
+			ctx.Warn(err3, "cannot parse labels")
+			return err3
+		}
+
 		homematic := HomematicDesc{
-			EnergyMetric:      device.Source.EnergyMetric,
-			TemperatureMetric: device.Source.TemperatureMetric,
-			LightMetric:       device.Source.LightMetric,
-			PowerMetric:       device.Source.PowerMetric,
-			HmName:            d.HmName,
-			Name:              d.Name,
-			Room:              d.Room,
-			ScriptUrl:         scriptUrl,
-			UserName:          device.Source.UserName,
-			Password:          device.Source.Password,
-			Interval:          duration.Seconds(),
+			Provider: device.Source.Provider,
+			Backend:  backend,
+			HmName:   d.HmName,
+			Name:     d.Name,
+			Room:     d.Room,
+			Interval: duration.Seconds(),
+			Stale:    stale,
+			Labels:   labels,
+			Metrics:  metrics,
+			Profiles: profiles,
+			Push:     push,
 		}
 
 		err := generateHomematic(ctx, devices, &homematic)
 
+		if isHomematicTransient(err) {
+			ctx.Warn(err, "cannot load homematic device data, keeping the device pending")
+			addHomematicPending(ctx, devices, &homematic)
+			continue
+		}
+
+		if err != nil && ctx.skipFailed {
+			ctx.Warn(err, "cannot load homematic device data, skipping the device")
+			continue
+		}
+
 		if err != nil {
 			ctx.Warn(err, "cannot load homematic device data")
+			return err
+		}
+	}
+
+	if device.Source.Sysvars != nil {
+		homematic := HomematicDesc{
+			Provider: device.Source.Provider,
+			Backend:  backend,
+			Interval: duration.Seconds(),
+			Stale:    stale,
+			Labels:   sourceLabels,
+		}
+
+		err := generateSysvars(ctx, devices, &homematic, device.Source.Sysvars)
+
+		if isHomematicTransient(err) {
+			ctx.Warn(err, "cannot load homematic system variables, trying again later")
+			devices.incomplete = true
+			devices.retry = true
+		} else if err != nil {
+			ctx.Warn(err, "cannot load homematic system variables")
+			return err
 		}
 	}
 
@@ -0,0 +1,519 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HomematicRpcError is returned when the JSON-RPC API of a CCU answers with
+// an error.
+type HomematicRpcError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *HomematicRpcError) Error() string {
+	return fmt.Sprintf("%s failed with code %d: %s", e.Method, e.Code, e.Message)
+}
+
+// accessDenied checks whether the CCU rejected the session of a call, e.g.
+// because it has expired. Other errors, like an unknown channel, are
+// answered within a valid session.
+func (e *HomematicRpcError) accessDenied() bool {
+	return e.Code == 400 || strings.Contains(strings.ToLower(e.Message), "access denied")
+}
+
+type homematicRpcChannel struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type homematicRpcDevice struct {
+	Id        string                `json:"id"`
+	Name      string                `json:"name"`
+	Address   string                `json:"address"`
+	Interface string                `json:"interface"`
+	Type      string                `json:"type"`
+	Channels  []homematicRpcChannel `json:"channels"`
+}
+
+type homematicRpcSysvar struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	Unit       string      `json:"unit"`
+	ValueList  string      `json:"valueList"`
+	ValueName0 string      `json:"valueName0"`
+	ValueName1 string      `json:"valueName1"`
+	Value      interface{} `json:"value"`
+}
+
+type homematicRpcRoom struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	ChannelIds []string `json:"channelIds"`
+}
+
+// homematicRpc is a client of the JSON-RPC API of a CCU. It is shared by all
+// devices of a source and logs in again, once the session has expired.
+type homematicRpc struct {
+	url       string
+	userName  string
+	password  string
+	transport http.RoundTripper
+
+	loginMu sync.Mutex
+	mu      sync.Mutex
+	id      int
+	session string
+	devices []homematicRpcDevice
+	rooms   map[string]string
+}
+
+func (r *homematicRpc) post(ctx Context, method string, params map[string]interface{}, result interface{}) error {
+	r.mu.Lock()
+	r.id++
+	id := r.id
+	r.mu.Unlock()
+
+	request, err := json.Marshal(map[string]interface{}{
+		"version": "1.1",
+		"method":  method,
+		"params":  params,
+		"id":      id,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	response, err := homematicClient(ctx, r.transport).Post(r.url, "application/json", bytes.NewReader(request))
+
+	if err != nil {
+		return &HomematicError{Kind: HomematicUnavailable, Err: err}
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return homematicStatusError(r.url, response.StatusCode)
+	}
+
+	body, err := io.ReadAll(response.Body)
+
+	if err != nil {
+		return &HomematicError{Kind: HomematicUnavailable, Err: err}
+	}
+
+	answer := struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+
+	if err = json.Unmarshal(body, &answer); err != nil {
+		return &ParseError{Err: err}
+	}
+
+	if answer.Error != nil {
+		return &HomematicRpcError{Method: method, Code: answer.Error.Code, Message: answer.Error.Message}
+	}
+
+	if err = json.Unmarshal(answer.Result, result); err != nil {
+		return &ParseError{Err: err}
+	}
+
+	return nil
+}
+
+// login replaces the rejected session by a new one. If a concurrent call has
+// replaced it already, its session is used, so that the limited number of
+// sessions of the CCU is not exhausted. The rejected session is logged out.
+func (r *homematicRpc) login(ctx Context, rejected string) (string, error) {
+	r.loginMu.Lock()
+	defer r.loginMu.Unlock()
+
+	r.mu.Lock()
+	current := r.session
+	r.mu.Unlock()
+
+	if current != rejected {
+		return current, nil
+	}
+
+	session := ""
+	params := map[string]interface{}{"username": r.userName, "password": r.password}
+
+	err := r.post(ctx, "Session.login", params, &session)
+
+	var rpcErr *HomematicRpcError
+
+	if errors.As(err, &rpcErr) {
+		return "", &HomematicError{Kind: HomematicAuth, Err: err}
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	r.session = session
+	r.mu.Unlock()
+
+	if rejected != "" {
+		var ok bool
+		r.post(ctx, "Session.logout", map[string]interface{}{"_session_id_": rejected}, &ok)
+	}
+
+	return session, nil
+}
+
+// call invokes a method of the JSON-RPC API within the current session. If
+// the CCU denies the access, the session is assumed to have expired and the
+// call is retried once with a new session.
+func (r *homematicRpc) call(ctx Context, method string, params map[string]interface{}, result interface{}) error {
+	r.mu.Lock()
+	session := r.session
+	r.mu.Unlock()
+
+	var err error
+
+	if session == "" {
+		if session, err = r.login(ctx, ""); err != nil {
+			return err
+		}
+	}
+
+	params["_session_id_"] = session
+	err = r.post(ctx, method, params, result)
+
+	var rpcErr *HomematicRpcError
+
+	if !errors.As(err, &rpcErr) {
+		return err
+	}
+
+	if !rpcErr.accessDenied() {
+		return &HomematicError{Kind: HomematicScript, Err: err}
+	}
+
+	if session, err = r.login(ctx, session); err != nil {
+		return err
+	}
+
+	params["_session_id_"] = session
+	err = r.post(ctx, method, params, result)
+
+	if errors.As(err, &rpcErr) {
+		return &HomematicError{Kind: HomematicScript, Err: err}
+	}
+
+	return err
+}
+
+// load reads the devices and rooms known to the CCU, unless they have been
+// read before.
+func (r *homematicRpc) load(ctx Context) error {
+	r.mu.Lock()
+	loaded := r.devices != nil
+	r.mu.Unlock()
+
+	if loaded {
+		return nil
+	}
+
+	devices := make([]homematicRpcDevice, 0)
+
+	if err := r.call(ctx, "Device.listAllDetail", map[string]interface{}{}, &devices); err != nil {
+		return err
+	}
+
+	rooms := make([]homematicRpcRoom, 0)
+
+	if err := r.call(ctx, "Room.getAll", map[string]interface{}{}, &rooms); err != nil {
+		return err
+	}
+
+	channelRooms := make(map[string]string)
+
+	for _, room := range rooms {
+		for _, id := range room.ChannelIds {
+			channelRooms[id] = room.Name
+		}
+	}
+
+	r.mu.Lock()
+	r.devices = devices
+	r.rooms = channelRooms
+	r.mu.Unlock()
+
+	return nil
+}
+
+// splitHmName splits a name like "HmIP-RF.0001DD89971DDD" into the interface
+// and the address of the device.
+func splitHmName(hmName string) (string, string, error) {
+	parts := strings.SplitN(hmName, ".", 2)
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid hm_name '%s', expecting interface.address", hmName)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func (r *homematicRpc) device(ctx Context, hmName string) (*homematicRpcDevice, error) {
+	iface, address, err := splitHmName(hmName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = r.load(ctx); err != nil {
+		return nil, err
+	}
+
+	for i := range r.devices {
+		if r.devices[i].Interface == iface && r.devices[i].Address == address {
+			return &r.devices[i], nil
+		}
+	}
+
+	return nil, &HomematicError{Kind: HomematicUnknownObject, Err: errors.New("unknown desc device: " + hmName)}
+}
+
+func (r *homematicRpc) endpoint() string {
+	return r.url
+}
+
+func (r *homematicRpc) listDevices(ctx Context) ([]homematicDeviceInfo, error) {
+	if err := r.load(ctx); err != nil {
+		return nil, err
+	}
+
+	devices := make([]homematicDeviceInfo, 0, len(r.devices))
+
+	for _, d := range r.devices {
+		info := homematicDeviceInfo{
+			hmName:   d.Interface + "." + d.Address,
+			hssType:  d.Type,
+			channels: make(map[int]homematicChannelInfo),
+		}
+
+		for _, c := range d.Channels {
+			if index, ok := channelIndex(c.Address); ok {
+				info.channels[index] = homematicChannelInfo{name: c.Name, room: r.rooms[c.Id]}
+			}
+		}
+
+		devices = append(devices, info)
+	}
+
+	return devices, nil
+}
+
+func (r *homematicRpc) readType(ctx Context, hmName string) (string, error) {
+	device, err := r.device(ctx, hmName)
+
+	if err != nil {
+		return "", err
+	}
+
+	return device.Type, nil
+}
+
+func (r *homematicRpc) readChannel(ctx Context, hmName string, channel int, datapoint string) (string, string, error) {
+	device, err := r.device(ctx, hmName)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	address := fmt.Sprintf("%s:%d", device.Address, channel)
+
+	for _, c := range device.Channels {
+		if c.Address == address {
+			return c.Name, r.rooms[c.Id], nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// readSysvars reads all system variables including their values.
+func (r *homematicRpc) readSysvars(ctx Context) ([]homematicRpcSysvar, error) {
+	sysvars := make([]homematicRpcSysvar, 0)
+
+	if err := r.call(ctx, "SysVar.getAll", map[string]interface{}{}, &sysvars); err != nil {
+		return nil, err
+	}
+
+	return sysvars, nil
+}
+
+// sysvarValues returns the values of all system variables by name.
+func (r *homematicRpc) sysvarValues(ctx Context) (map[string]interface{}, error) {
+	all, err := r.readSysvars(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{}, len(all))
+
+	for _, s := range all {
+		values[s.Name] = s.Value
+	}
+
+	return values, nil
+}
+
+func (r *homematicRpc) listSysvars(ctx Context) ([]homematicSysvar, error) {
+	all, err := r.readSysvars(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sysvars := make([]homematicSysvar, 0, len(all))
+
+	for _, s := range all {
+		sysvar := homematicSysvar{name: s.Name, kind: sysvarNumber, unit: s.Unit}
+
+		switch s.Type {
+		case "BOOL", "LOGIC", "ALARM":
+			sysvar.kind = sysvarBool
+			sysvar.values = []string{s.ValueName0, s.ValueName1}
+		case "LIST", "ENUM":
+			sysvar.kind = sysvarList
+			sysvar.values = strings.Split(s.ValueList, ";")
+		case "STRING":
+			sysvar.kind = sysvarText
+		}
+
+		sysvars = append(sysvars, sysvar)
+	}
+
+	return sysvars, nil
+}
+
+// readValues reads the datapoints of all devices of a batch. The paramset of
+// each channel and the system variables are read only once.
+func (r *homematicRpc) readValues(ctx Context, batch []DeviceInterface) ([]float64, []error) {
+	values := make([]float64, len(batch))
+	errs := make([]error, len(batch))
+	paramsets := make(map[string]map[string]interface{})
+	failed := make(map[string]error)
+
+	var sysvars map[string]interface{}
+	var sysvarErr error
+
+	for i, d := range batch {
+		hm := d.(*HomematicDevice)
+
+		if hm.sysvar != nil {
+			if sysvars == nil && sysvarErr == nil {
+				sysvars, sysvarErr = r.sysvarValues(ctx)
+			}
+
+			if sysvarErr != nil {
+				errs[i] = sysvarErr
+				continue
+			}
+
+			raw, ok := sysvars[hm.sysvar.name]
+			values[i], errs[i] = hm.parseValue(raw, ok)
+			continue
+		}
+
+		iface, address, err1 := splitHmName(hm.hmName)
+
+		if err1 != nil {
+			errs[i] = err1
+			continue
+		}
+
+		channel := fmt.Sprintf("%s:%d", address, hm.dpChannel)
+		key := iface + "|" + channel
+		paramset, ok := paramsets[key]
+
+		if !ok {
+			if err, ok := failed[key]; ok {
+				errs[i] = err
+				continue
+			}
+
+			params := map[string]interface{}{"interface": iface, "address": channel, "paramsetKey": "VALUES"}
+
+			if err2 := r.call(ctx, "Interface.getParamset", params, &paramset); err2 != nil {
+				failed[key] = err2
+				errs[i] = err2
+				continue
+			}
+
+			paramsets[key] = paramset
+		}
+
+		raw, ok := paramset[hm.dpName]
+		values[i], errs[i] = hm.parseValue(raw, ok)
+	}
+
+	return values, errs
+}
+
+func LoadHomematicRpcDevices(ctx Context, devices *Devices, device Device) error {
+	var protocol = "http"
+	if device.Source.UseSSL {
+		protocol += "s"
+	}
+
+	transport, err := newHomematicTransport(ctx.Root, device)
+
+	if err != nil {
+		ctx.Warn(err, "cannot configure tls")
+		return err
+	}
+
+	rpc := &homematicRpc{
+		url:       fmt.Sprintf("%s://%s/api/homematic.cgi", protocol, device.Source.Address),
+		userName:  device.Source.UserName,
+		password:  device.Source.Password,
+		transport: transport,
+	}
+
+	return loadHomematic(ctx, devices, device, rpc)
+}
@@ -0,0 +1,386 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package devices
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fceller/home2grafana/tools/ccu-jsonrpc/ccu"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+func newRpcTest(t *testing.T, password string) (*homematicRpc, *ccu.Server, Context) {
+	server := ccu.NewServer(ccu.Fixtures(), "Admin", "secret", 0)
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	rpc := &homematicRpc{url: ts.URL + "/api/homematic.cgi", userName: "Admin", password: password}
+	ctx := Context{NetClient: ts.Client(), Clog: logrus.WithField("test", t.Name())}
+
+	return rpc, server, ctx
+}
+
+func rpcDevice(rpc *homematicRpc, hmName string, channel int, datapoint string) *HomematicDevice {
+	return &HomematicDevice{
+		provider:  "homematic-jsonrpc",
+		backend:   rpc,
+		hmName:    hmName,
+		category:  "energy",
+		dpChannel: channel,
+		dpName:    datapoint,
+	}
+}
+
+func TestHomematicRpcLogin(t *testing.T) {
+	rpc, server, ctx := newRpcTest(t, "wrong")
+
+	if _, err := rpc.listDevices(ctx); !IsAuthError(err) {
+		t.Fatalf("expected an auth error, got %v", err)
+	}
+
+	rpc, server, ctx = newRpcTest(t, "secret")
+	infos, err := rpc.listDevices(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) == 0 || infos[0].hmName != "HmIP-RF.0001DD89971DDD" || infos[0].hssType != "HMIP-PSM" {
+		t.Fatalf("unexpected devices %v", infos)
+	}
+
+	if infos[0].channels[6].name != "Server Energie" {
+		t.Errorf("expected the name of channel 6, got %v", infos[0].channels)
+	}
+
+	hssType, err := rpc.readType(ctx, "HmIP-RF.0001DD89971DDD")
+
+	if err != nil || hssType != "HMIP-PSM" {
+		t.Errorf("expected HMIP-PSM, got %q, %v", hssType, err)
+	}
+
+	if server.Logins() != 1 {
+		t.Errorf("expected a single login, got %d", server.Logins())
+	}
+}
+
+func TestHomematicRpcReadValues(t *testing.T) {
+	rpc, server, ctx := newRpcTest(t, "secret")
+
+	batch := []DeviceInterface{
+		rpcDevice(rpc, "HmIP-RF.0001DD89971DDD", 6, "ENERGY_COUNTER"),
+		rpcDevice(rpc, "HmIP-RF.0001DD89971DDD", 6, "POWER"),
+		rpcDevice(rpc, "HmIP-RF.0001DD89971DDD", 6, "MISSING"),
+		rpcDevice(rpc, "HmIP-RF.0001DD89971DDD", 9, "POWER"),
+	}
+
+	values, errs := rpc.readValues(ctx, batch)
+
+	if errs[0] != nil || values[0] != 184523.7 {
+		t.Errorf("expected 184523.7, got %v, %v", values[0], errs[0])
+	}
+
+	if errs[1] != nil || values[1] != 98.45 {
+		t.Errorf("expected 98.45, got %v, %v", values[1], errs[1])
+	}
+
+	var hmErr *HomematicError
+
+	if !errors.As(errs[2], &hmErr) || hmErr.Kind != HomematicUnknownObject {
+		t.Errorf("expected an unknown object error, got %v", errs[2])
+	}
+
+	if !errors.As(errs[3], &hmErr) || hmErr.Kind != HomematicScript {
+		t.Errorf("expected a script error, got %v", errs[3])
+	}
+
+	// an unknown channel is answered within the session
+	if server.Logins() != 1 || server.Sessions() != 1 {
+		t.Errorf("expected a single session, got %d logins and %d sessions", server.Logins(), server.Sessions())
+	}
+}
+
+func TestHomematicRpcSessionRetry(t *testing.T) {
+	rpc, server, ctx := newRpcTest(t, "secret")
+	batch := []DeviceInterface{rpcDevice(rpc, "HmIP-RF.0001DD89971DDD", 6, "POWER")}
+
+	if _, errs := rpc.readValues(ctx, batch); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+
+	server.Expire()
+	values, errs := rpc.readValues(ctx, batch)
+
+	if errs[0] != nil || values[0] != 98.45 {
+		t.Fatalf("expected 98.45 after a new login, got %v, %v", values[0], errs[0])
+	}
+
+	if server.Logins() != 2 || server.Sessions() != 1 {
+		t.Errorf("expected two logins and one session, got %d and %d", server.Logins(), server.Sessions())
+	}
+}
+
+func TestHomematicRpcSysvars(t *testing.T) {
+	rpc, server, ctx := newRpcTest(t, "secret")
+	sysvars, err := rpc.listSysvars(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := map[string]string{
+		"Anwesenheit":      sysvarBool,
+		"Heizung Modus":    sysvarList,
+		"Heizung Sollwert": sysvarNumber,
+		"Letzte Meldung":   sysvarText,
+	}
+
+	if len(sysvars) != len(kinds) {
+		t.Fatalf("expected %d system variables, got %d", len(kinds), len(sysvars))
+	}
+
+	batch := make([]DeviceInterface, 0, len(sysvars))
+
+	for i := range sysvars {
+		if kinds[sysvars[i].name] != sysvars[i].kind {
+			t.Errorf("expected %s to be %s, got %s", sysvars[i].name, kinds[sysvars[i].name], sysvars[i].kind)
+		}
+
+		if sysvars[i].kind != sysvarText {
+			batch = append(batch, &HomematicDevice{provider: "homematic-jsonrpc", backend: rpc, sysvar: &sysvars[i]})
+		}
+	}
+
+	values, errs := rpc.readValues(ctx, batch)
+	expected := []float64{1, 2, 21.5}
+
+	for i := range batch {
+		if errs[i] != nil || values[i] != expected[i] {
+			t.Errorf("expected %v, got %v, %v", expected[i], values[i], errs[i])
+		}
+	}
+
+	if server.Logins() != 1 {
+		t.Errorf("expected a single login, got %d", server.Logins())
+	}
+}
+
+func TestHomematicRpcConcurrentLogin(t *testing.T) {
+	rpc, server, ctx := newRpcTest(t, "secret")
+	done := make(chan error)
+
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, errs := rpc.readValues(ctx, []DeviceInterface{rpcDevice(rpc, "HmIP-RF.0001DD89971DDD", 6, "POWER")})
+			done <- errs[0]
+		}()
+	}
+
+	timeout := time.After(10 * time.Second)
+
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-timeout:
+			t.Fatal("timeout")
+		}
+	}
+
+	if server.Logins() != 1 {
+		t.Errorf("expected a single login, got %d", server.Logins())
+	}
+}
+
+// loadRpcTest loads a Homematic source from the stand-in.
+func loadRpcTest(t *testing.T, skipFailed bool, source string) (*Devices, error) {
+	rpc, _, ctx := newRpcTest(t, "secret")
+	ctx.Root = t.TempDir()
+	ctx.skipFailed = skipFailed
+	device := Device{}
+
+	if err := yaml.Unmarshal([]byte(source), &device); err != nil {
+		t.Fatal(err)
+	}
+
+	devs := &Devices{ByDID: make(map[string]DeviceList)}
+	devs.Devices = new([]DeviceInterface)
+
+	return devs, loadHomematic(ctx, devs, device, rpc)
+}
+
+// TestHomematicServiceMetrics checks that the service metrics are exported
+// for a listed device, too.
+func TestHomematicServiceMetrics(t *testing.T) {
+	devs, err := loadRpcTest(t, false, `
+source:
+  provider: homematic-jsonrpc
+  energy_metric: energy_watthour
+  service_metrics: true
+  interval: 60s
+  devices:
+    - hm_name: HmIP-RF.0001DD89971DDD
+      name: Server
+`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := make(map[string]bool)
+
+	for _, d := range *devs.Devices {
+		if d.Name() == "Server" {
+			metrics[d.MetricName()] = true
+		}
+	}
+
+	for _, metric := range []string{"energy_watthour", "homematic_unreachable", "homematic_rssi_dbm"} {
+		if !metrics[metric] {
+			t.Errorf("expected %s for the listed device, got %v", metric, metrics)
+		}
+	}
+}
+
+// TestHomematicUnknownDevice checks that an unknown device is skipped at
+// startup, but fails a reload.
+func TestHomematicUnknownDevice(t *testing.T) {
+	source := `
+source:
+  provider: homematic-jsonrpc
+  energy_metric: energy_watthour
+  interval: 60s
+  devices:
+    - hm_name: HmIP-RF.0000000000000
+      name: Renamed
+    - hm_name: HmIP-RF.0001DD89971DDD
+      name: Server
+`
+
+	devs, err := loadRpcTest(t, true, source)
+
+	if err != nil || devs.Length() != 1 || (*devs.Devices)[0].Name() != "Server" {
+		t.Errorf("expected the unknown device to be skipped at startup, got %v", err)
+	}
+
+	if _, err := loadRpcTest(t, false, source); err == nil {
+		t.Error("expected the unknown device to fail a reload")
+	}
+}
+
+// TestHomematicPending checks that a device, which cannot be looked up
+// while the CCU is not available, is kept as a single pending device, and
+// that a reload keeps the devices of the previous load.
+func TestHomematicPending(t *testing.T) {
+	ts := httptest.NewServer(nil)
+	ts.Close()
+
+	rpc := &homematicRpc{url: ts.URL + "/api/homematic.cgi", userName: "Admin", password: "secret"}
+	ctx := Context{Root: t.TempDir(), NetClient: ts.Client(), Clog: logrus.WithField("test", t.Name())}
+	device := Device{}
+
+	if err := yaml.Unmarshal([]byte(`
+source:
+  provider: homematic-jsonrpc
+  energy_metric: energy_watthour
+  power_metric: power_watt
+  interval: 60s
+  devices:
+    - hm_name: HmIP-RF.0001DD89971DDD
+    - hm_name: BidCos-RF.LEQ0535163
+      name: Waschmaschine
+`), &device); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(previous *Devices) *Devices {
+		devs := &Devices{ByDID: make(map[string]DeviceList)}
+		devs.Devices = new([]DeviceInterface)
+		ctx.previous = previous
+
+		if err := loadHomematic(ctx, devs, device, rpc); err != nil {
+			t.Fatal(err)
+		}
+
+		return devs
+	}
+
+	devs := load(nil)
+
+	if !devs.Incomplete() || devs.Length() != 2 {
+		t.Fatalf("expected a pending device per device, got %d", devs.Length())
+	}
+
+	for i, name := range []string{"HmIP-RF.0001DD89971DDD", "Waschmaschine"} {
+		d := (*devs.Devices)[i]
+
+		if !IsPending(d) || d.MetricName() != "" || d.Name() != name {
+			t.Errorf("expected a pending device without metric named %s, got %s", name, d.FullName())
+		}
+	}
+
+	previous := &Devices{ByDID: make(map[string]DeviceList)}
+	previous.addDevice(&HomematicDevice{
+		provider: "homematic-jsonrpc",
+		hmName:   "BidCos-RF.LEQ0535163",
+		metric:   "power_watt",
+	})
+	devs = load(previous)
+
+	if devs.Length() != 3 || (*devs.Devices)[1].MetricName() != "power_watt" {
+		t.Errorf("expected the previous device to be kept, got %d devices", devs.Length())
+	}
+}
+
+// TestHomematicSysvarSelection checks that an invalid selection of system
+// variables fails loading.
+func TestHomematicSysvarSelection(t *testing.T) {
+	source := func(selection string) string {
+		return `
+source:
+  provider: homematic-jsonrpc
+  interval: 60s
+  sysvars:
+` + selection
+	}
+
+	devs, err := loadRpcTest(t, false, source("    names: [Anwesenheit]\n    regex: ^Heizung\n"))
+
+	if err != nil || devs.Length() != 3 {
+		t.Errorf("expected 3 system variables, got %v", err)
+	}
+
+	for _, selection := range []string{"    names: [Anwesenhiet]\n", "    regex: ^(Heizung\n"} {
+		if _, err := loadRpcTest(t, true, source(selection)); err == nil {
+			t.Errorf("expected an error for %s", selection)
+		}
+	}
+}
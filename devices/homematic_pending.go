@@ -0,0 +1,172 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package devices
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HomematicPending stands in for a configured device, which could not be
+// looked up while loading, because the CCU was not available or rejected
+// the credentials. It exports no value, only the health of the device, so
+// that the device is reported as down or suspended instead of disappearing.
+// Its datapoints are not known yet, so each device has a single pending
+// device looking it up on every poll. Once the device can be looked up, the
+// setup is loaded again to create the real devices.
+type HomematicPending struct {
+	provider string
+	backend  homematicBackend
+	name     string
+	room     string
+	hmName   string
+	interval float64
+	lastText
+	staleConfig
+	labelSet
+}
+
+func (t *HomematicPending) DeviceID() string {
+	return fmt.Sprintf("%s: %s", t.provider, t.hmName)
+}
+
+func (t *HomematicPending) Name() string {
+	return t.name
+}
+
+func (t *HomematicPending) Room() string {
+	return t.room
+}
+
+func (t *HomematicPending) FullName() string {
+	return fmt.Sprintf(
+		"[provider:%s,hm:%s,name:%s,room:%s,interval:%v,pending]",
+		t.provider,
+		t.hmName,
+		t.name,
+		t.room,
+		t.interval,
+	)
+}
+
+func (t *HomematicPending) LogName() string {
+	return fmt.Sprintf("Homematic(%s/%s)", t.hmName, t.name)
+}
+
+func (t *HomematicPending) Labels() []string {
+	return t.withLabels(t.provider, t.name, t.room)
+}
+
+func (t *HomematicPending) ProviderName() string {
+	return t.provider
+}
+
+func (t *HomematicPending) Endpoint() string {
+	return t.backend.endpoint()
+}
+
+func (t *HomematicPending) IntervalSec() uint64 {
+	return uint64(t.interval)
+}
+
+// MetricName is empty, a pending device exports no value.
+func (t *HomematicPending) MetricName() string {
+	return ""
+}
+
+func (t *HomematicPending) CategoryName() string {
+	return ""
+}
+
+func (t *HomematicPending) Datapoint() string {
+	return "pending lookup"
+}
+
+// CurrentValue looks up the device again. Until the setup has been loaded
+// again, no value is available.
+func (t *HomematicPending) CurrentValue(ctx Context) (float64, error) {
+	if _, err := t.backend.readType(ctx, t.hmName); err != nil {
+		return 0, err
+	}
+
+	requestReload(fmt.Sprintf("homematic device %s available", t.hmName))
+	return 0, &HomematicError{Kind: HomematicUnavailable, Err: errors.New("device available, waiting for reload")}
+}
+
+// isHomematicTransient checks whether an error may go away without changing
+// the setup, e.g. while the CCU reboots. Rejected credentials count as
+// transient, the devices are suspended until the setup has been fixed.
+func isHomematicTransient(err error) bool {
+	var hmErr *HomematicError
+	return errors.As(err, &hmErr) && (hmErr.Kind == HomematicUnavailable || hmErr.Kind == HomematicAuth)
+}
+
+// addHomematicPending creates the pending device. On a reload, the devices
+// of the previous load are kept as well, so that their series are reported
+// as down or suspended instead of disappearing.
+func addHomematicPending(ctx Context, devices *Devices, desc *HomematicDesc) {
+	pending := &HomematicPending{
+		provider:    desc.Provider,
+		backend:     desc.Backend,
+		name:        desc.Name,
+		room:        desc.Room,
+		hmName:      desc.HmName,
+		interval:    desc.Interval,
+		staleConfig: staleConfig{desc.Stale},
+		labelSet:    desc.Labels,
+	}
+
+	// the name given by the CCU is not known, but the labels must tell the
+	// pending devices apart
+	if pending.name == "" {
+		pending.name = desc.HmName
+	}
+
+	if ctx.previous != nil {
+		if previous, ok := ctx.previous.ByDID[pending.DeviceID()]; ok {
+			for _, d := range *previous.Devices {
+				if _, ok := d.(*HomematicDevice); ok {
+					devices.addDevice(d)
+				}
+			}
+		}
+	}
+
+	devices.addDevice(pending)
+	devices.incomplete = true
+
+	ctx.PushFields(logrus.Fields{"name": pending.name, "room": pending.room})
+	ctx.Info("found pending device")
+	ctx.Pop()
+}
+
+// IsPending checks whether a device stands in for a device, which could not
+// be looked up while loading. It exports no value, only its health.
+func IsPending(d DeviceInterface) bool {
+	_, ok := d.(*HomematicPending)
+	return ok
+}
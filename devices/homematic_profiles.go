@@ -0,0 +1,160 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// HomematicProfilesFile is the name of the file in the setup directory,
+// which extends or overrides the built-in Homematic profiles.
+const HomematicProfilesFile = "homematic_profiles.yaml"
+
+//go:embed homematic_profiles.yaml
+var builtinHomematicProfiles []byte
+
+// homematicCategories lists the categories a profile can refer to. Each of
+// them is exported using the metric "<category>_metric" of the source.
+var homematicCategories = map[string]bool{
+	"energy":          true,
+	"power":           true,
+	"temperature":     true,
+	"light":           true,
+	"setpoint":        true,
+	"setpoint_mode":   true,
+	"valve":           true,
+	"boost":           true,
+	"window":          true,
+	"humidity":        true,
+	"battery_voltage": true,
+	"low_battery":     true,
+	"unreachable":     true,
+	"rssi":            true,
+	"duty_cycle":      true,
+}
+
+// homematicServiceMetrics maps the service categories to their fixed metric
+// names. They are exported, if the source enables service_metrics.
+var homematicServiceMetrics = map[string]string{
+	"battery_voltage": "homematic_battery_voltage",
+	"low_battery":     "homematic_battery_low",
+	"unreachable":     "homematic_unreachable",
+	"rssi":            "homematic_rssi_dbm",
+	"duty_cycle":      "homematic_duty_cycle_percent",
+}
+
+// homematicReceiver is the radio module of the CCU, which reports the duty
+// cycle.
+const homematicReceiver = "HmIP-RF.HmIP-RCV-1"
+
+// HomematicDatapoint describes a single datapoint of a Homematic device.
+type HomematicDatapoint struct {
+	Category  string  `yaml:"category"`
+	Channel   int     `yaml:"channel"`
+	Datapoint string  `yaml:"datapoint"`
+	Unit      string  `yaml:"unit,omitempty"`
+	Scale     float64 `yaml:"scale,omitempty"`
+}
+
+// HomematicProfiles maps a HssType to the datapoints read from a device.
+type HomematicProfiles map[string][]HomematicDatapoint
+
+// parseHomematicProfiles parses profiles, unknown keys are rejected.
+func parseHomematicProfiles(data []byte) (HomematicProfiles, error) {
+	profiles := HomematicProfiles{}
+	err := yaml.UnmarshalStrict(data, &profiles)
+	return profiles, err
+}
+
+// validateHomematicProfiles rejects datapoints of unknown categories and
+// datapoints without a name, which could never be read.
+func validateHomematicProfiles(profiles HomematicProfiles) error {
+	hssTypes := make([]string, 0, len(profiles))
+
+	for hssType := range profiles {
+		hssTypes = append(hssTypes, hssType)
+	}
+
+	sort.Strings(hssTypes)
+
+	for _, hssType := range hssTypes {
+		for _, dp := range profiles[hssType] {
+			if !homematicCategories[dp.Category] {
+				return fmt.Errorf("unknown category '%s' in profile '%s'", dp.Category, hssType)
+			}
+
+			if dp.Datapoint == "" {
+				return fmt.Errorf("datapoint missing in profile '%s'", hssType)
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadHomematicProfiles returns the built-in profiles merged with the
+// profiles defined in the setup directory. A profile of the setup directory
+// replaces the built-in profile of the same HssType.
+func LoadHomematicProfiles(setup string) (HomematicProfiles, error) {
+	profiles, err := parseHomematicProfiles(builtinHomematicProfiles)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(setup, HomematicProfilesFile))
+
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := parseHomematicProfiles(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateHomematicProfiles(overrides); err != nil {
+		return nil, err
+	}
+
+	for hssType, datapoints := range overrides {
+		profiles[hssType] = datapoints
+	}
+
+	return profiles, nil
+}
@@ -0,0 +1,90 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package devices
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHomematicBatteryProfiles checks that every built-in profile of a
+// battery powered device reports the state of its battery.
+func TestHomematicBatteryProfiles(t *testing.T) {
+	profiles, err := LoadHomematicProfiles(t.TempDir())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	battery := []string{"HM-WDS10-TH-O", "HM-WDS40-TH-I", "HM-Sec-MDIR-2", "HM-WDS100-C6-O", "HmIP-SMI", "HmIP-SMI55"}
+
+	for _, hssType := range battery {
+		found := false
+
+		for _, dp := range profiles[hssType] {
+			if dp.Category == "battery_voltage" || (dp.Category == "low_battery" && dp.Datapoint == "LOW_BAT") {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("%s reports no battery state", hssType)
+		}
+	}
+}
+
+// TestHomematicProfileOverrides checks that a user-defined profile replaces
+// the built-in one and that a typo fails loading.
+func TestHomematicProfileOverrides(t *testing.T) {
+	tests := []struct {
+		profile string
+		err     string
+	}{
+		{"HMIP-PSM:\n  - category: energy\n    channel: 6\n    datapoint: ENERGY_COUNTER\n", ""},
+		{"HMIP-PSM:\n  - category: energy\n    channel: 6\n    datpoint: ENERGY_COUNTER\n", "datpoint"},
+		{"HMIP-PSM:\n  - category: enrgy\n    channel: 6\n    datapoint: ENERGY_COUNTER\n", "unknown category"},
+		{"HMIP-PSM:\n  - category: energy\n    channel: 6\n", "datapoint missing"},
+	}
+
+	for _, test := range tests {
+		setup := t.TempDir()
+
+		if err := ioutil.WriteFile(filepath.Join(setup, HomematicProfilesFile), []byte(test.profile), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		profiles, err := LoadHomematicProfiles(setup)
+
+		if test.err == "" {
+			if err != nil || len(profiles["HMIP-PSM"]) != 1 {
+				t.Errorf("expected the profile to be replaced, got %v", err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected an error containing '%s', got %v", test.err, err)
+		}
+	}
+}
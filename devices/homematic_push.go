@@ -0,0 +1,474 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// homematicInterfacePorts are the ports of the XML-RPC interfaces of a CCU,
+// which push value changes. The second port is used with ssl.
+var homematicInterfacePorts = map[string][2]string{
+	"BidCos-RF": {"2001", "42001"},
+	"HmIP-RF":   {"2010", "42010"},
+}
+
+// homematicPushSource describes how to reach the XML-RPC interfaces of the
+// CCU of a source with push enabled.
+type homematicPushSource struct {
+	host      string
+	ssl       bool
+	discover  bool
+	userName  string
+	password  string
+	transport http.RoundTripper
+}
+
+// newHomematicPushSource uses the host of the source address, the XML-RPC
+// interfaces listen on their own ports.
+func newHomematicPushSource(device Device, transport http.RoundTripper) *homematicPushSource {
+	host := device.Source.Address
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return &homematicPushSource{
+		host:      host,
+		ssl:       device.Source.UseSSL,
+		discover:  device.Source.Discover,
+		userName:  device.Source.UserName,
+		password:  device.Source.Password,
+		transport: transport,
+	}
+}
+
+// url returns the url of an XML-RPC interface of the CCU.
+func (p *homematicPushSource) url(iface string) (string, error) {
+	ports, ok := homematicInterfacePorts[iface]
+
+	if !ok {
+		return "", fmt.Errorf("interface '%s' does not push events", iface)
+	}
+
+	if p.ssl {
+		return fmt.Sprintf("https://%s", net.JoinHostPort(p.host, ports[1])), nil
+	}
+
+	return fmt.Sprintf("http://%s", net.JoinHostPort(p.host, ports[0])), nil
+}
+
+// pushKey returns the key of the events updating a device, which is
+// "<interface>.<address>:<channel>.<datapoint>". Devices without push have
+// no key.
+func (t *HomematicDevice) pushKey() string {
+	if t.push == nil || t.sysvar != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d.%s", t.hmName, t.dpChannel, t.dpName)
+}
+
+// HomematicEvent is a value pushed by a CCU for a device.
+type HomematicEvent struct {
+	Device DeviceInterface
+	Value  float64
+	Err    error
+	Time   time.Time
+}
+
+// homematicRegistration is a callback registered with an XML-RPC interface
+// of a CCU.
+type homematicRegistration struct {
+	id      string
+	iface   string
+	url     string
+	source  *homematicPushSource
+	devices map[string][]*HomematicDevice
+}
+
+// HomematicReceiver receives the events pushed by the XML-RPC interfaces of
+// the CCUs. It registers itself with every interface used by a device with
+// push enabled and registers again periodically, so that a restarted CCU
+// keeps sending events.
+type HomematicReceiver struct {
+	ctx      Context
+	callback string
+	handler  func(HomematicEvent)
+
+	mu            sync.Mutex
+	registrations map[string]*homematicRegistration
+	ids           map[string]string
+	next          int
+
+	// known holds the versions of the devices announced by newDevices by
+	// registration id, so that the CCU announces only devices added later
+	known map[string]map[string]int64
+}
+
+// NewHomematicReceiver creates a receiver, which is reachable by the CCUs at
+// the callback url and hands each event to the handler.
+func NewHomematicReceiver(ctx Context, callback string, handler func(HomematicEvent)) *HomematicReceiver {
+	return &HomematicReceiver{
+		ctx:           ctx,
+		callback:      callback,
+		handler:       handler,
+		registrations: make(map[string]*homematicRegistration),
+		ids:           make(map[string]string),
+		known:         make(map[string]map[string]int64),
+	}
+}
+
+// Register replaces the registrations by those needed for the devices. The
+// interfaces no longer used are asked to stop sending events.
+func (r *HomematicReceiver) Register(devs *Devices) {
+	wanted := make(map[string]*homematicRegistration)
+
+	for _, d := range *devs.Devices {
+		hm, ok := d.(*HomematicDevice)
+
+		if !ok || hm.pushKey() == "" {
+			continue
+		}
+
+		iface, _, err := splitHmName(hm.hmName)
+
+		if err != nil {
+			continue
+		}
+
+		url, err := hm.push.url(iface)
+
+		if err != nil {
+			r.ctx.Clog.WithField("device", hm.LogName()).WithError(err).Warn("cannot push device")
+			continue
+		}
+
+		reg, ok := wanted[url]
+
+		if !ok {
+			reg = &homematicRegistration{
+				iface:   iface,
+				url:     url,
+				source:  hm.push,
+				devices: make(map[string][]*HomematicDevice),
+			}
+			wanted[url] = reg
+		}
+
+		key := hm.pushKey()
+		reg.devices[key] = append(reg.devices[key], hm)
+	}
+
+	r.mu.Lock()
+	removed := make([]*homematicRegistration, 0)
+
+	for url, reg := range r.registrations {
+		if _, ok := wanted[url]; !ok {
+			removed = append(removed, reg)
+			delete(r.ids, reg.id)
+		}
+	}
+
+	for url, reg := range wanted {
+		if current, ok := r.registrations[url]; ok {
+			reg.id = current.id
+		} else {
+			r.next++
+			reg.id = fmt.Sprintf("home2grafana-%d", r.next)
+		}
+
+		r.ids[reg.id] = url
+	}
+
+	r.registrations = wanted
+	r.mu.Unlock()
+
+	for _, reg := range removed {
+		go r.init(reg, false)
+	}
+
+	for _, reg := range wanted {
+		go r.init(reg, true)
+	}
+}
+
+// Run registers again with all interfaces at every interval.
+func (r *HomematicReceiver) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.mu.Lock()
+		registrations := make([]*homematicRegistration, 0, len(r.registrations))
+
+		for _, reg := range r.registrations {
+			registrations = append(registrations, reg)
+		}
+
+		r.mu.Unlock()
+
+		for _, reg := range registrations {
+			r.init(reg, true)
+		}
+	}
+}
+
+// init registers the callback with an interface or, if register is false,
+// removes it.
+func (r *HomematicReceiver) init(reg *homematicRegistration, register bool) {
+	clog := r.ctx.Clog.WithFields(logrus.Fields{"interface": reg.iface, "url": reg.url})
+	client := homematicClient(r.ctx, reg.source.transport)
+	params := []interface{}{r.callback, reg.id}
+
+	if !register {
+		params = params[:1]
+	}
+
+	_, err := callXmlRpc(r.ctx, client, reg.url, reg.source.userName, reg.source.password, "init", params...)
+
+	if err != nil {
+		clog.WithError(err).Warn("cannot register for events, polling only")
+		return
+	}
+
+	if register {
+		clog.WithField("devices", len(reg.devices)).Info("registered for events")
+	} else {
+		clog.Info("unregistered from events")
+	}
+}
+
+// ServeHTTP answers the XML-RPC calls of the CCUs.
+func (r *HomematicReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	call := xmlrpcMethodCall{}
+
+	if err = parseXml(r.ctx, body, &call); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := make([]interface{}, len(call.Params))
+
+	for i := range call.Params {
+		if params[i], err = call.Params[i].decode(); err != nil {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write(writeXmlRpcFault(-1, err.Error()))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(writeXmlRpcResponse(r.call(call.MethodName, params)))
+}
+
+// call handles a single method. The CCU delivers events in batches using
+// system.multicall.
+func (r *HomematicReceiver) call(method string, params []interface{}) interface{} {
+	switch method {
+	case "system.multicall":
+		if len(params) != 1 {
+			return []interface{}{}
+		}
+
+		calls, _ := params[0].([]interface{})
+		results := make([]interface{}, 0, len(calls))
+
+		for _, c := range calls {
+			m, _ := c.(map[string]interface{})
+			name, _ := m["methodName"].(string)
+			p, _ := m["params"].([]interface{})
+
+			if name == "system.multicall" {
+				results = append(results, map[string]interface{}{
+					"faultCode":   -1,
+					"faultString": "recursive system.multicall",
+				})
+				continue
+			}
+
+			results = append(results, []interface{}{r.call(name, p)})
+		}
+
+		return results
+	case "system.listMethods":
+		return []interface{}{"system.listMethods", "system.multicall", "event", "listDevices", "newDevices",
+			"deleteDevices", "updateDevice", "replaceDevice", "readdedDevice"}
+	case "event":
+		if len(params) == 4 {
+			id, _ := params[0].(string)
+			address, _ := params[1].(string)
+			datapoint, _ := params[2].(string)
+			r.event(id, address, datapoint, params[3])
+		}
+
+		return ""
+	case "listDevices":
+		// the CCU sends the devices missing from this list through
+		// newDevices
+		if len(params) >= 1 {
+			id, _ := params[0].(string)
+			return r.listDevices(id)
+		}
+
+		return []interface{}{}
+	case "newDevices":
+		if len(params) == 2 {
+			id, _ := params[0].(string)
+			descriptions, _ := params[1].([]interface{})
+			r.newDevices(id, descriptions)
+		}
+
+		return ""
+	case "deleteDevices":
+		if len(params) == 2 {
+			id, _ := params[0].(string)
+			addresses, _ := params[1].([]interface{})
+			r.deleteDevices(id, addresses)
+		}
+
+		return ""
+	default:
+		return ""
+	}
+}
+
+// listDevices returns the devices announced to a registration before.
+func (r *HomematicReceiver) listDevices(id string) []interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	devices := make([]interface{}, 0, len(r.known[id]))
+
+	for address, version := range r.known[id] {
+		devices = append(devices, map[string]interface{}{"ADDRESS": address, "VERSION": version})
+	}
+
+	return devices
+}
+
+// newDevices remembers the devices announced by the CCU. The first
+// announcement after the start contains all devices of the CCU. Devices
+// announced later have been added to the CCU, the setup is loaded again to
+// discover them.
+func (r *HomematicReceiver) newDevices(id string, descriptions []interface{}) {
+	r.mu.Lock()
+	reg, ok := r.registrations[r.ids[id]]
+	known, initialized := r.known[id]
+
+	if !initialized {
+		known = make(map[string]int64)
+		r.known[id] = known
+	}
+
+	added := make([]string, 0)
+
+	for _, d := range descriptions {
+		description, _ := d.(map[string]interface{})
+		address, _ := description["ADDRESS"].(string)
+		version, _ := description["VERSION"].(int64)
+		parent, _ := description["PARENT"].(string)
+
+		if address == "" {
+			continue
+		}
+
+		if _, ok := known[address]; !ok && parent == "" {
+			added = append(added, address)
+		}
+
+		known[address] = version
+	}
+
+	r.mu.Unlock()
+
+	if !ok || !initialized || len(added) == 0 {
+		return
+	}
+
+	r.ctx.Clog.WithFields(logrus.Fields{"interface": reg.iface, "devices": added}).Info("new devices")
+
+	if reg.source.discover {
+		requestReload(fmt.Sprintf("new %s devices", reg.iface))
+	}
+}
+
+// deleteDevices forgets the devices removed from the CCU and loads the setup
+// again to remove discovered devices.
+func (r *HomematicReceiver) deleteDevices(id string, addresses []interface{}) {
+	r.mu.Lock()
+	reg, ok := r.registrations[r.ids[id]]
+
+	for _, a := range addresses {
+		if address, _ := a.(string); address != "" {
+			delete(r.known[id], address)
+		}
+	}
+
+	r.mu.Unlock()
+
+	if ok && reg.source.discover {
+		requestReload(fmt.Sprintf("deleted %s devices", reg.iface))
+	}
+}
+
+// event updates all devices of a registration reading the datapoint.
+func (r *HomematicReceiver) event(id string, address string, datapoint string, raw interface{}) {
+	r.mu.Lock()
+	reg, ok := r.registrations[r.ids[id]]
+	r.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, hm := range reg.devices[fmt.Sprintf("%s.%s.%s", reg.iface, address, datapoint)] {
+		value, err := hm.parseValue(raw, true)
+		r.handler(HomematicEvent{Device: hm, Value: value, Err: err, Time: time.Now()})
+	}
+}
+
+// UsesPush checks whether a device should be updated by pushed events.
+func UsesPush(devs *Devices) bool {
+	for _, d := range *devs.Devices {
+		if hm, ok := d.(*HomematicDevice); ok && hm.pushKey() != "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,145 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package devices
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// pushCall posts an XML-RPC call to the receiver and returns the decoded
+// result.
+func pushCall(t *testing.T, r *HomematicReceiver, method string, params ...interface{}) interface{} {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(writeXmlRpcCall(method, params...)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	response := xmlrpcMethodResponse{}
+
+	if err := parseXml(xmlRpcTestContext(t), w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Fault != nil {
+		t.Fatalf("unexpected fault %+v", response.Fault)
+	}
+
+	if len(response.Params) != 1 {
+		t.Fatalf("expected a single result, got %d", len(response.Params))
+	}
+
+	result, err := response.Params[0].decode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+// drainReloads removes a pending reload request.
+func drainReloads() string {
+	select {
+	case reason := <-reloads:
+		return reason
+	default:
+		return ""
+	}
+}
+
+func TestHomematicReceiverMulticall(t *testing.T) {
+	r := NewHomematicReceiver(xmlRpcTestContext(t), "http://host:9877", func(HomematicEvent) {})
+
+	if result := pushCall(t, r, "system.multicall"); !reflect.DeepEqual(result, []interface{}{}) {
+		t.Errorf("expected no results without calls, got %#v", result)
+	}
+
+	result := pushCall(t, r, "system.multicall", []interface{}{
+		map[string]interface{}{"methodName": "event", "params": []interface{}{"id", "LEQ0535163:1", "STATE", true}},
+		map[string]interface{}{"methodName": "system.multicall", "params": []interface{}{[]interface{}{}}},
+		map[string]interface{}{"methodName": "event"},
+	})
+
+	expected := []interface{}{
+		[]interface{}{""},
+		map[string]interface{}{"faultCode": int64(-1), "faultString": "recursive system.multicall"},
+		[]interface{}{""},
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %#v, got %#v", expected, result)
+	}
+}
+
+func TestHomematicReceiverNewDevices(t *testing.T) {
+	r := NewHomematicReceiver(xmlRpcTestContext(t), "http://host:9877", func(HomematicEvent) {})
+	r.registrations["http://ccu:2001"] = &homematicRegistration{
+		id:     "id-1",
+		iface:  "BidCos-RF",
+		url:    "http://ccu:2001",
+		source: &homematicPushSource{host: "ccu", discover: true},
+	}
+	r.ids["id-1"] = "http://ccu:2001"
+	drainReloads()
+
+	device := func(address string, parent string) map[string]interface{} {
+		return map[string]interface{}{"ADDRESS": address, "PARENT": parent, "VERSION": int64(1)}
+	}
+
+	pushCall(t, r, "newDevices", "id-1", []interface{}{device("LEQ0535163", ""), device("LEQ0535163:1", "LEQ0535163")})
+
+	if reason := drainReloads(); reason != "" {
+		t.Errorf("the first announcement should not load the setup again, got %s", reason)
+	}
+
+	if result := pushCall(t, r, "listDevices", "id-1"); len(result.([]interface{})) != 2 {
+		t.Errorf("expected the announced devices, got %#v", result)
+	}
+
+	pushCall(t, r, "newDevices", "id-1", []interface{}{device("LEQ0535163:2", "LEQ0535163")})
+
+	if reason := drainReloads(); reason != "" {
+		t.Errorf("a new channel should not load the setup again, got %s", reason)
+	}
+
+	pushCall(t, r, "newDevices", "id-1", []interface{}{device("MEQ0000001", "")})
+
+	if reason := drainReloads(); reason != "new BidCos-RF devices" {
+		t.Errorf("a new device should load the setup again, got '%s'", reason)
+	}
+
+	pushCall(t, r, "deleteDevices", "id-1", []interface{}{"MEQ0000001"})
+
+	if reason := drainReloads(); reason != "deleted BidCos-RF devices" {
+		t.Errorf("a deleted device should load the setup again, got '%s'", reason)
+	}
+
+	if result := pushCall(t, r, "listDevices", "id-1"); len(result.([]interface{})) != 3 {
+		t.Errorf("expected the remaining devices, got %#v", result)
+	}
+}
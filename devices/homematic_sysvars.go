@@ -0,0 +1,264 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultSysvarMetric is the metric of the system variables, unless the
+// source defines a different one.
+const DefaultSysvarMetric = "homematic_sysvar"
+
+// SysvarSelection selects the system variables of a CCU, which are exported.
+// A variable is selected, if it is listed in names or matches the regex.
+type SysvarSelection struct {
+	Metric string   `yaml:"metric,omitempty"`
+	Names  []string `yaml:"names,omitempty"`
+	Regex  string   `yaml:"regex,omitempty"`
+}
+
+// MetricName returns the metric of the selected system variables.
+func (s *SysvarSelection) MetricName() string {
+	if s.Metric == "" {
+		return DefaultSysvarMetric
+	}
+
+	return s.Metric
+}
+
+const (
+	sysvarNumber = "number"
+	sysvarBool   = "bool"
+	sysvarList   = "list"
+	sysvarText   = "text"
+)
+
+// homematicSysvar describes a system variable of a CCU. Booleans are exported
+// as 0 and 1, value lists as the index of the value.
+type homematicSysvar struct {
+	name   string
+	kind   string
+	values []string
+	unit   string
+}
+
+// newHomematicSysvar creates a system variable from the value type and
+// subtype used by ReGa and the XML-API.
+func newHomematicSysvar(name string, valueType string, subType string, valueList string,
+	valueName0 string, valueName1 string, unit string) homematicSysvar {
+
+	sysvar := homematicSysvar{name: name, kind: sysvarNumber, unit: unit}
+
+	switch {
+	case valueType == "2":
+		sysvar.kind = sysvarBool
+		sysvar.values = []string{valueName0, valueName1}
+	case valueType == "16" && subType == "29":
+		sysvar.kind = sysvarList
+		sysvar.values = strings.Split(valueList, ";")
+	case valueType == "20":
+		sysvar.kind = sysvarText
+	}
+
+	return sysvar
+}
+
+func (s *homematicSysvar) category() string {
+	if s.kind == sysvarNumber {
+		return "sysvar"
+	}
+
+	return "sysvar_enum"
+}
+
+// text returns the text of a value, which is the name of the value for
+// booleans and value lists.
+func (s *homematicSysvar) text(value float64) string {
+	if s.kind == sysvarNumber {
+		return formatHomematicValue("sysvar", s.unit, value)
+	}
+
+	i := int(value)
+
+	if i >= 0 && i < len(s.values) && s.values[i] != "" {
+		return s.values[i]
+	}
+
+	if s.kind == sysvarBool {
+		return strconv.FormatBool(value != 0)
+	}
+
+	return strconv.Itoa(i)
+}
+
+// ValueName returns the name of a boolean or value list system variable.
+func (t *HomematicDevice) ValueName(value float64) (string, bool) {
+	if t.sysvar == nil || t.sysvar.kind == sysvarNumber {
+		return "", false
+	}
+
+	return t.sysvar.text(value), true
+}
+
+// regaString escapes a string used as literal in a ReGa script.
+func regaString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// listSysvars returns all system variables. The fields of a variable are
+// separated by tabs, the variables by newlines.
+func (h *homematicScript) listSysvars(ctx Context) ([]homematicSysvar, error) {
+	listCmd := `var sysvars = "";
+		string id;
+		foreach (id, dom.GetObject(ID_SYSTEM_VARIABLES).EnumUsedIDs()) {
+			var o = dom.GetObject(id);
+			sysvars = sysvars # o.Name() # "\t" # o.ValueType() # "\t" # o.ValueSubType() # "\t" # o.ValueList() # "\t" # o.ValueName0() # "\t" # o.ValueName1() # "\t" # o.ValueUnit() # "\n";
+		}`
+
+	info := homematicValuesXml{}
+	err1 := h.readXml(ctx, listCmd, &info)
+
+	if err1 != nil {
+		return nil, err1
+	}
+
+	sysvars := make([]homematicSysvar, 0)
+
+	for _, v := range info.Values {
+		if v.XMLName.Local != "sysvars" {
+			continue
+		}
+
+		for _, line := range strings.Split(v.Text, "\n") {
+			fields := strings.Split(line, "\t")
+
+			if len(fields) != 7 {
+				continue
+			}
+
+			sysvars = append(sysvars, newHomematicSysvar(
+				fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]))
+		}
+	}
+
+	return sysvars, nil
+}
+
+// selectSysvars returns the system variables selected by the source.
+func selectSysvars(sysvars []homematicSysvar, selection *SysvarSelection) ([]homematicSysvar, error) {
+	var re *regexp.Regexp
+
+	if selection.Regex != "" {
+		var err error
+
+		if re, err = regexp.Compile(selection.Regex); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for _, name := range selection.Names {
+		names[name] = true
+	}
+
+	selected := make([]homematicSysvar, 0)
+
+	for _, sysvar := range sysvars {
+		if names[sysvar.name] || (re != nil && re.MatchString(sysvar.name)) {
+			selected = append(selected, sysvar)
+			delete(names, sysvar.name)
+		}
+	}
+
+	for name := range names {
+		return selected, &HomematicError{Kind: HomematicUnknownObject, Err: fmt.Errorf("unknown system variable '%s'", name)}
+	}
+
+	return selected, nil
+}
+
+// generateSysvars creates a device for each system variable selected by the
+// source.
+// A selection naming an unknown system variable is rejected like any other
+// error in the setup.
+func generateSysvars(ctx Context, devices *Devices, desc *HomematicDesc, selection *SysvarSelection) error {
+	// an invalid regex is rejected, even if the CCU is not available
+	if _, err := regexp.Compile(selection.Regex); err != nil {
+		return err
+	}
+
+	all, err := desc.Backend.listSysvars(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	selected, err := selectSysvars(all, selection)
+
+	if err != nil {
+		return err
+	}
+
+	count := 0
+
+	for i := range selected {
+		sysvar := selected[i]
+
+		if sysvar.kind == sysvarText {
+			ctx.PushField("sysvar", sysvar.name)
+			ctx.Info("skipping text system variable")
+			ctx.Pop()
+			continue
+		}
+
+		device := HomematicDevice{
+			provider:    desc.Provider,
+			backend:     desc.Backend,
+			name:        sysvar.name,
+			hmName:      "sysvar:" + sysvar.name,
+			interval:    desc.Interval,
+			staleConfig: staleConfig{desc.Stale},
+			labelSet:    desc.Labels,
+			metric:      selection.MetricName(),
+			category:    sysvar.category(),
+			sysvar:      &sysvar,
+		}
+
+		devices.addDevice(&device)
+		count++
+	}
+
+	ctx.PushField("count", count)
+	ctx.Info("found system variables")
+	ctx.Pop()
+
+	return nil
+}
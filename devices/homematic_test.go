@@ -0,0 +1,82 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package devices
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestHomematicScriptListDevices checks that discovery takes the HssType,
+// names and rooms from a single script.
+func TestHomematicScriptListDevices(t *testing.T) {
+	scripts := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scripts++
+		script, _ := io.ReadAll(r.Body)
+
+		if !strings.Contains(string(script), "HssType()") || !strings.Contains(string(script), "ChnRoom()") {
+			t.Errorf("unexpected script %s", script)
+		}
+
+		w.Write([]byte("<xml><exec>/Test.exe</exec><sessionId></sessionId><httpUserAgent></httpUserAgent>" +
+			"<devices>D\tHmIP-RF.0001DD89971DDD\tHMIP-PSM\n" +
+			"C\t0001DD89971DDD:0\tHMIP-PSM 0001DD89971DDD:0\t\n" +
+			"C\t0001DD89971DDD:6\tServer Energie\tKeller\n" +
+			"D\tBidCos-RF.LEQ0535163\tHM-ES-PMSw1-Pl\n" +
+			"C\tLEQ0535163:2\tWaschmaschine\tBad\n</devices></xml>"))
+	}))
+	defer ts.Close()
+
+	script := &homematicScript{url: ts.URL}
+	ctx := Context{NetClient: ts.Client(), Clog: logrus.WithField("test", t.Name())}
+	infos, err := script.listDevices(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 2 || scripts != 1 {
+		t.Fatalf("expected two devices from one script, got %v from %d", infos, scripts)
+	}
+
+	if infos[0].hmName != "HmIP-RF.0001DD89971DDD" || infos[0].hssType != "HMIP-PSM" {
+		t.Errorf("unexpected device %v", infos[0])
+	}
+
+	if c := infos[0].channels[6]; c.name != "Server Energie" || c.room != "Keller" {
+		t.Errorf("unexpected channel %v", c)
+	}
+
+	if c := infos[1].channels[2]; infos[1].hssType != "HM-ES-PMSw1-Pl" || c.name != "Waschmaschine" || c.room != "Bad" {
+		t.Errorf("unexpected device %v", infos[1])
+	}
+}
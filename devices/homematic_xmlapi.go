@@ -0,0 +1,367 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+type xmlApiChannel struct {
+	Name    string `xml:"name,attr"`
+	Address string `xml:"address,attr"`
+	IseId   string `xml:"ise_id,attr"`
+}
+
+type xmlApiDeviceList struct {
+	XMLName xml.Name `xml:"deviceList"`
+	Devices []struct {
+		Name       string          `xml:"name,attr"`
+		Address    string          `xml:"address,attr"`
+		IseId      string          `xml:"ise_id,attr"`
+		Interface  string          `xml:"interface,attr"`
+		DeviceType string          `xml:"device_type,attr"`
+		Channels   []xmlApiChannel `xml:"channel"`
+	} `xml:"device"`
+}
+
+type xmlApiRoomList struct {
+	XMLName xml.Name `xml:"roomList"`
+	Rooms   []struct {
+		Name     string `xml:"name,attr"`
+		IseId    string `xml:"ise_id,attr"`
+		Channels []struct {
+			IseId string `xml:"ise_id,attr"`
+		} `xml:"channel"`
+	} `xml:"room"`
+}
+
+type xmlApiSysvarList struct {
+	XMLName xml.Name `xml:"systemVariables"`
+	Sysvars []struct {
+		Name       string `xml:"name,attr"`
+		Value      string `xml:"value,attr"`
+		ValueList  string `xml:"value_list,attr"`
+		ValueName0 string `xml:"value_name_0,attr"`
+		ValueName1 string `xml:"value_name_1,attr"`
+		Unit       string `xml:"unit,attr"`
+		Type       string `xml:"type,attr"`
+		Subtype    string `xml:"subtype,attr"`
+	} `xml:"systemVariable"`
+}
+
+type xmlApiStateList struct {
+	XMLName xml.Name `xml:"stateList"`
+	Devices []struct {
+		Channels []struct {
+			Datapoints []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"datapoint"`
+		} `xml:"channel"`
+	} `xml:"device"`
+}
+
+// homematicXmlApi accesses a CCU using the XML-API add-on. The device and
+// room lists are read once, the states of all datapoints are read with a
+// single request per batch.
+type homematicXmlApi struct {
+	url       string
+	sid       string
+	transport http.RoundTripper
+
+	mu      sync.Mutex
+	devices *xmlApiDeviceList
+	rooms   map[string]string
+}
+
+func (x *homematicXmlApi) endpoint() string {
+	return x.url
+}
+
+// get reads a page of the XML-API. The pages declare their encoding, which
+// is ISO-8859-1, and are decoded by parseXml.
+func (x *homematicXmlApi) get(ctx Context, page string, result interface{}) error {
+	pageUrl := x.url + "/" + page
+
+	if x.sid != "" {
+		pageUrl += "?sid=" + url.QueryEscape(x.sid)
+	}
+
+	response, err := homematicClient(ctx, x.transport).Get(pageUrl)
+
+	if err != nil {
+		return &HomematicError{Kind: HomematicUnavailable, Err: err}
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return homematicStatusError(x.url+"/"+page, response.StatusCode)
+	}
+
+	body, err := io.ReadAll(response.Body)
+
+	if err != nil {
+		return &HomematicError{Kind: HomematicUnavailable, Err: err}
+	}
+
+	// the add-on answers an invalid session id with an empty element
+	if bytes.Contains(body, []byte("<not_authenticated")) {
+		return &HomematicError{Kind: HomematicAuth, Err: fmt.Errorf("%s: not authenticated", page)}
+	}
+
+	if err = parseXml(ctx, body, result); err != nil {
+		return &HomematicError{Kind: HomematicScript, Err: &ParseError{Err: err}}
+	}
+
+	return nil
+}
+
+// load reads the device and room lists, unless they have been read before.
+func (x *homematicXmlApi) load(ctx Context) error {
+	x.mu.Lock()
+	loaded := x.devices != nil
+	x.mu.Unlock()
+
+	if loaded {
+		return nil
+	}
+
+	devices := xmlApiDeviceList{}
+
+	if err := x.get(ctx, "devicelist.cgi", &devices); err != nil {
+		return err
+	}
+
+	rooms := xmlApiRoomList{}
+
+	if err := x.get(ctx, "roomlist.cgi", &rooms); err != nil {
+		return err
+	}
+
+	channelRooms := make(map[string]string)
+
+	for _, room := range rooms.Rooms {
+		for _, c := range room.Channels {
+			channelRooms[c.IseId] = room.Name
+		}
+	}
+
+	x.mu.Lock()
+	x.devices = &devices
+	x.rooms = channelRooms
+	x.mu.Unlock()
+
+	return nil
+}
+
+func (x *homematicXmlApi) listDevices(ctx Context) ([]homematicDeviceInfo, error) {
+	if err := x.load(ctx); err != nil {
+		return nil, err
+	}
+
+	devices := make([]homematicDeviceInfo, 0, len(x.devices.Devices))
+
+	for _, d := range x.devices.Devices {
+		info := homematicDeviceInfo{
+			hmName:   d.Interface + "." + d.Address,
+			hssType:  d.DeviceType,
+			channels: make(map[int]homematicChannelInfo),
+		}
+
+		for _, c := range d.Channels {
+			if index, ok := channelIndex(c.Address); ok {
+				info.channels[index] = homematicChannelInfo{name: c.Name, room: x.rooms[c.IseId]}
+			}
+		}
+
+		devices = append(devices, info)
+	}
+
+	return devices, nil
+}
+
+func (x *homematicXmlApi) readType(ctx Context, hmName string) (string, error) {
+	iface, address, err := splitHmName(hmName)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err = x.load(ctx); err != nil {
+		return "", err
+	}
+
+	for _, d := range x.devices.Devices {
+		if d.Interface == iface && d.Address == address {
+			return d.DeviceType, nil
+		}
+	}
+
+	return "", &HomematicError{Kind: HomematicUnknownObject, Err: errors.New("unknown desc device: " + hmName)}
+}
+
+func (x *homematicXmlApi) readChannel(ctx Context, hmName string, channel int, datapoint string) (string, string, error) {
+	iface, address, err := splitHmName(hmName)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if err = x.load(ctx); err != nil {
+		return "", "", err
+	}
+
+	channelAddress := fmt.Sprintf("%s:%d", address, channel)
+
+	for _, d := range x.devices.Devices {
+		if d.Interface != iface || d.Address != address {
+			continue
+		}
+
+		for _, c := range d.Channels {
+			if c.Address == channelAddress {
+				return c.Name, x.rooms[c.IseId], nil
+			}
+		}
+	}
+
+	return "", "", nil
+}
+
+func (x *homematicXmlApi) listSysvars(ctx Context) ([]homematicSysvar, error) {
+	list := xmlApiSysvarList{}
+
+	if err := x.get(ctx, "sysvarlist.cgi", &list); err != nil {
+		return nil, err
+	}
+
+	sysvars := make([]homematicSysvar, 0, len(list.Sysvars))
+
+	for _, s := range list.Sysvars {
+		sysvars = append(sysvars, newHomematicSysvar(
+			s.Name, s.Type, s.Subtype, s.ValueList, s.ValueName0, s.ValueName1, s.Unit))
+	}
+
+	return sysvars, nil
+}
+
+// readValues reads the state list and the system variables once and looks up
+// the values of all devices of the batch. Datapoints are named
+// "<hm_name>:<channel>.<name>". A page is only read, if the batch needs it.
+func (x *homematicXmlApi) readValues(ctx Context, batch []DeviceInterface) ([]float64, []error) {
+	values := make([]float64, len(batch))
+	errs := make([]error, len(batch))
+	found := make(map[string]string)
+	var datapoints, sysvars bool
+
+	for _, d := range batch {
+		if d.(*HomematicDevice).sysvar != nil {
+			sysvars = true
+		} else {
+			datapoints = true
+		}
+	}
+
+	if datapoints {
+		states := xmlApiStateList{}
+
+		if err1 := x.get(ctx, "statelist.cgi", &states); err1 != nil {
+			for i := range errs {
+				errs[i] = err1
+			}
+
+			return values, errs
+		}
+
+		for _, d := range states.Devices {
+			for _, c := range d.Channels {
+				for _, dp := range c.Datapoints {
+					found[dp.Name] = dp.Value
+				}
+			}
+		}
+	}
+
+	if sysvars {
+		list := xmlApiSysvarList{}
+
+		if err2 := x.get(ctx, "sysvarlist.cgi", &list); err2 != nil {
+			for i := range errs {
+				errs[i] = err2
+			}
+
+			return values, errs
+		}
+
+		for _, s := range list.Sysvars {
+			found["sysvar:"+s.Name] = s.Value
+		}
+	}
+
+	for i, d := range batch {
+		hm := d.(*HomematicDevice)
+		name := fmt.Sprintf("%s:%d.%s", hm.hmName, hm.dpChannel, hm.dpName)
+
+		if hm.sysvar != nil {
+			name = hm.hmName
+		}
+
+		text, ok := found[name]
+		values[i], errs[i] = hm.parseValue(text, ok && text != "")
+	}
+
+	return values, errs
+}
+
+func LoadHomematicXmlApiDevices(ctx Context, devices *Devices, device Device) error {
+	var protocol = "http"
+	if device.Source.UseSSL {
+		protocol += "s"
+	}
+
+	transport, err := newHomematicTransport(ctx.Root, device)
+
+	if err != nil {
+		ctx.Warn(err, "cannot configure tls")
+		return err
+	}
+
+	xmlApi := &homematicXmlApi{
+		url:       fmt.Sprintf("%s://%s/addons/xmlapi", protocol, device.Source.Address),
+		sid:       device.Source.Password,
+		transport: transport,
+	}
+
+	return loadHomematic(ctx, devices, device, xmlApi)
+}
@@ -29,6 +29,7 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
+	"net/http"
 	"strconv"
 	"time"
 )
@@ -39,8 +40,11 @@ type IoBrokerDevice struct {
 	room           string
 	interval       float64
 	address        string
+	server         string
 	temperatureUrl string
-	lastValue      string
+	lastText
+	staleConfig
+	labelSet
 }
 
 func (t *IoBrokerDevice) DeviceID() string {
@@ -71,7 +75,15 @@ func (t *IoBrokerDevice) LogName() string {
 }
 
 func (t *IoBrokerDevice) Labels() []string {
-	return []string{"iobroker", t.name, t.room}
+	return t.withLabels("iobroker", t.name, t.room)
+}
+
+func (t *IoBrokerDevice) ProviderName() string {
+	return "iobroker"
+}
+
+func (t *IoBrokerDevice) Endpoint() string {
+	return t.server
 }
 
 func (t *IoBrokerDevice) IntervalSec() uint64 {
@@ -86,6 +98,10 @@ func (t *IoBrokerDevice) CategoryName() string {
 	return "temperature"
 }
 
+func (t *IoBrokerDevice) Datapoint() string {
+	return t.address
+}
+
 func (t *IoBrokerDevice) CurrentValue(ctx Context) (float64, error) {
 	response, err1 := ctx.NetClient.Get(t.temperatureUrl)
 
@@ -95,6 +111,10 @@ func (t *IoBrokerDevice) CurrentValue(ctx Context) (float64, error) {
 
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		return 0, &StatusError{Url: t.temperatureUrl, StatusCode: response.StatusCode}
+	}
+
 	body, err2 := io.ReadAll(response.Body)
 
 	if err2 != nil {
@@ -104,30 +124,40 @@ func (t *IoBrokerDevice) CurrentValue(ctx Context) (float64, error) {
 	temp, err3 := strconv.ParseFloat(string(body), 64)
 
 	if err3 != nil {
-		return 0, err3
+		return 0, &ParseError{Err: err3}
 	}
 
-	t.lastValue = fmt.Sprintf("%.2f °C", temp)
+	t.setLastValue(fmt.Sprintf("%.2f °C", temp))
 	return temp, nil
 }
 
-func (t *IoBrokerDevice) LastValue() string {
-	return t.lastValue
-}
-
 func LoadIoBrokerDevices(ctx Context, devices *Devices, device Device) error {
 	duration, err := time.ParseDuration(device.Source.Interval)
 
 	if err != nil {
 		ctx.Warn(err, "cannot parse duration")
-		return nil
+		return err
 	}
 
 	if duration < 0 {
 		duration = 60
 	}
 
+	stale, err := parseStaleness(device)
+
+	if err != nil {
+		ctx.Warn(err, "cannot parse staleness")
+		return err
+	}
+
 	for _, d := range device.Source.Devices {
+		labels, err := newLabelSet(device.Source.Labels, d.Labels)
+
+		if err != nil {
+			ctx.Warn(err, "cannot parse labels")
+			return err
+		}
+
 		temperatureUrl := fmt.Sprintf("http://%s/getPlainValue/%s", device.Source.Address, d.Address)
 
 		if device.Source.TemperatureMetric != "" {
@@ -137,7 +167,10 @@ func LoadIoBrokerDevices(ctx Context, devices *Devices, device Device) error {
 				metric:         device.Source.TemperatureMetric,
 				temperatureUrl: temperatureUrl,
 				address:        d.Address,
+				server:         device.Source.Address,
 				interval:       duration.Seconds(),
+				staleConfig:    staleConfig{stale},
+				labelSet:       labels,
 			}
 
 			ctx.PushFields(logrus.Fields{"name": iobroker.name, "room": iobroker.room, "address": iobroker.address})
@@ -30,6 +30,7 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
+	"strconv"
 	"time"
 
 	"encoding/json"
@@ -43,9 +44,17 @@ type TasmotaDevice struct {
 	interval  float64
 	category  string
 	address   string
+	channel   int
+	sensor    string
 	energyUrl string
 	statusUrl string
-	lastValue string
+
+	// pending is set, if the plug could not be asked for its name, channels
+	// or sensors while loading
+	pending bool
+	lastText
+	staleConfig
+	labelSet
 }
 
 type TasmotaStatus struct {
@@ -74,23 +83,86 @@ type TasmotaStatus struct {
 
 type TasmotaEnergy struct {
 	StatusSNS struct {
-		Time   string `json:"Time"`
-		ENERGY struct {
-			TotalStartTime string  `json:"TotalStartTime"`
-			Total          float64 `json:"Total"`
-			Yesterday      float64 `json:"Yesterday"`
-			Today          float64 `json:"Today"`
-			Power          int     `json:"Power"`
-			ApparentPower  int     `json:"ApparentPower"`
-			ReactivePower  int     `json:"ReactivePower"`
-			Factor         float64 `json:"Factor"`
-			Voltage        int     `json:"Voltage"`
-			Current        float64 `json:"Current"`
+		Time         string `json:"Time"`
+		TempUnit     string `json:"TempUnit"`
+		PressureUnit string `json:"PressureUnit"`
+		ENERGY       struct {
+			TotalStartTime string        `json:"TotalStartTime"`
+			Total          tasmotaValues `json:"Total"`
+			Yesterday      tasmotaValues `json:"Yesterday"`
+			Today          tasmotaValues `json:"Today"`
+			Power          tasmotaValues `json:"Power"`
+			ApparentPower  tasmotaValues `json:"ApparentPower"`
+			ReactivePower  tasmotaValues `json:"ReactivePower"`
+			Factor         tasmotaValues `json:"Factor"`
+			Voltage        tasmotaValues `json:"Voltage"`
+			Current        tasmotaValues `json:"Current"`
 		} `json:"ENERGY"`
 	} `json:"StatusSNS"`
+
+	// sensors holds the other objects of StatusSNS by name
+	sensors map[string]tasmotaSensor
+}
+
+// tasmotaValues holds a reading of the ENERGY section, which is a number
+// for a single channel and an array for several channels or phases.
+type tasmotaValues []float64
+
+func (v *tasmotaValues) UnmarshalJSON(data []byte) error {
+	values := []float64{}
+
+	if err := json.Unmarshal(data, &values); err == nil {
+		*v = values
+		return nil
+	}
+
+	var value float64
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	*v = tasmotaValues{value}
+	return nil
+}
+
+// value returns the reading of a channel, counted from 1. Channel 0 stands
+// for all channels, which are summed or, if average is set, averaged.
+func (v tasmotaValues) value(channel int, average bool) (float64, error) {
+	if len(v) == 0 {
+		return 0, &ParseError{Err: errors.New("no value")}
+	}
+
+	if channel > len(v) {
+		return 0, &ParseError{Err: fmt.Errorf("no value for channel %d", channel)}
+	}
+
+	if channel > 0 {
+		return v[channel-1], nil
+	}
+
+	sum := 0.0
+
+	for _, value := range v {
+		sum += value
+	}
+
+	if average {
+		return sum / float64(len(v)), nil
+	}
+
+	return sum, nil
 }
 
 func (t *TasmotaDevice) DeviceID() string {
+	if t.sensor != "" {
+		return fmt.Sprintf("tasmota: %s/%s", t.address, t.sensor)
+	}
+
+	if t.channel > 0 {
+		return fmt.Sprintf("tasmota: %s/%d", t.address, t.channel)
+	}
+
 	return fmt.Sprintf("tasmota: %s", t.address)
 }
 
@@ -103,21 +175,44 @@ func (t *TasmotaDevice) Room() string {
 }
 
 func (t *TasmotaDevice) FullName() string {
+	pending := ""
+
+	if t.pending {
+		pending = ",pending"
+	}
+
 	return fmt.Sprintf(
-		"%s[provider:tasmota,name:%s,room:%s,interval:%v]",
+		"%s[provider:tasmota,name:%s,room:%s,interval:%v%s]",
 		t.metric,
 		t.name,
 		t.room,
 		t.interval,
+		pending,
 	)
 }
 
 func (t *TasmotaDevice) LogName() string {
+	if t.sensor != "" {
+		return fmt.Sprintf("Tasmota(%s/%s)", t.name, t.sensor)
+	}
+
+	if t.channel > 0 {
+		return fmt.Sprintf("Tasmota(%s/%d)", t.name, t.channel)
+	}
+
 	return fmt.Sprintf("Tasmota(%s)", t.name)
 }
 
 func (t *TasmotaDevice) Labels() []string {
-	return []string{"tasmota", t.name, t.room}
+	return t.withLabels("tasmota", t.name, t.room)
+}
+
+func (t *TasmotaDevice) ProviderName() string {
+	return "tasmota"
+}
+
+func (t *TasmotaDevice) Endpoint() string {
+	return t.address
 }
 
 func (t *TasmotaDevice) IntervalSec() uint64 {
@@ -133,42 +228,154 @@ func (t *TasmotaDevice) CategoryName() string {
 }
 
 func (t *TasmotaDevice) CurrentValue(ctx Context) (float64, error) {
+	values, errs := t.ReadBatch(ctx, []DeviceInterface{t})
+	return values[0], errs[0]
+}
+
+// BatchKey groups the categories and channels of a plug, which are all read from the same
+// Status 10 answer.
+func (t *TasmotaDevice) BatchKey() string {
+	return fmt.Sprintf("tasmota: %s", t.address)
+}
+
+// errTasmotaPending is returned by the devices of a pending plug, once the
+// plug answers. The channels and sensors are only known after the setup has
+// been loaded again.
+var errTasmotaPending = errors.New("plug available, waiting for reload")
+
+// ReadBatch requests Status 10 once and takes the values of all categories
+// of the batch from the answer.
+func (t *TasmotaDevice) ReadBatch(ctx Context, batch []DeviceInterface) ([]float64, []error) {
+	values := make([]float64, len(batch))
+	errs := make([]error, len(batch))
+	tasmota, err := t.readEnergy(ctx)
+
+	if err == nil && t.pending {
+		requestReload(fmt.Sprintf("tasmota %s available", t.address))
+		err = errTasmotaPending
+	}
+
+	for i, d := range batch {
+		if err != nil {
+			errs[i] = err
+		} else {
+			values[i], errs[i] = d.(*TasmotaDevice).value(tasmota)
+		}
+	}
+
+	return values, errs
+}
+
+func (t *TasmotaDevice) readEnergy(ctx Context) (*TasmotaEnergy, error) {
 	response, err1 := ctx.NetClient.Get(t.energyUrl)
 
 	if err1 != nil {
-		return 0, err1
+		return nil, err1
 	}
 
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		return nil, &StatusError{Url: t.energyUrl, StatusCode: response.StatusCode}
+	}
+
 	body, err2 := io.ReadAll(response.Body)
 
 	if err2 != nil {
-		return 0, err2
+		return nil, err2
 	}
 
 	tasmota := TasmotaEnergy{}
 	err3 := json.Unmarshal([]byte(body), &tasmota)
 
 	if err3 != nil {
-		return 0, err3
+		return nil, &ParseError{Err: err3}
+	}
+
+	tasmota.sensors = parseTasmotaSensors(body)
+	return &tasmota, nil
+}
+
+// value returns the value of a sensor or an energy reading.
+func (t *TasmotaDevice) value(tasmota *TasmotaEnergy) (float64, error) {
+	if t.sensor != "" {
+		return t.sensorValue(tasmota)
 	}
 
-	if t.category == "energy" {
-		value := tasmota.StatusSNS.ENERGY.Total * 1000
-		t.lastValue = fmt.Sprintf("%.2f kW/h", value/1000)
-		return value, nil
-	} else if t.category == "power" {
-		value := float64(tasmota.StatusSNS.ENERGY.Power)
-		t.lastValue = fmt.Sprintf("%.2f W/h", value)
-		return value, nil
-	} else {
-		return 0, errors.New(fmt.Sprintf("unknown category %s", t.category))
+	return t.energyValue(tasmota)
+}
+
+// tasmotaReading describes a category read from the ENERGY section of
+// Status 10. Energy is exported in Wh, Tasmota reports kWh.
+type tasmotaReading struct {
+	category string
+	key      string
+	format   string
+	factor   float64
+	average  bool
+	field    func(tasmota *TasmotaEnergy) tasmotaValues
+}
+
+// tasmotaReadings lists the categories in the order the devices of a plug
+// are created. Voltage and power factor of several channels are averaged
+// instead of summed.
+var tasmotaReadings = []tasmotaReading{
+	{"energy", "Total", "%.2f kW/h", 1000, false,
+		func(t *TasmotaEnergy) tasmotaValues { return t.StatusSNS.ENERGY.Total }},
+	{"power", "Power", "%.2f W/h", 1, false, func(t *TasmotaEnergy) tasmotaValues { return t.StatusSNS.ENERGY.Power }},
+	{"voltage", "Voltage", "%.0f V", 1, true, func(t *TasmotaEnergy) tasmotaValues { return t.StatusSNS.ENERGY.Voltage }},
+	{"current", "Current", "%.3f A", 1, false, func(t *TasmotaEnergy) tasmotaValues { return t.StatusSNS.ENERGY.Current }},
+	{"power_factor", "Factor", "%.2f", 1, true, func(t *TasmotaEnergy) tasmotaValues { return t.StatusSNS.ENERGY.Factor }},
+	{"apparent_power", "ApparentPower", "%.0f VA", 1, false,
+		func(t *TasmotaEnergy) tasmotaValues { return t.StatusSNS.ENERGY.ApparentPower }},
+	{"reactive_power", "ReactivePower", "%.0f var", 1, false,
+		func(t *TasmotaEnergy) tasmotaValues { return t.StatusSNS.ENERGY.ReactivePower }},
+	{"energy_today", "Today", "%.2f kW/h", 1000, false,
+		func(t *TasmotaEnergy) tasmotaValues { return t.StatusSNS.ENERGY.Today }},
+}
+
+func (t *TasmotaDevice) Datapoint() string {
+	if t.pending {
+		return "pending discovery"
 	}
+
+	if t.sensor != "" {
+		return fmt.Sprintf("StatusSNS.%s.%s", t.sensor, tasmotaSensorKeys[t.category])
+	}
+
+	for _, r := range tasmotaReadings {
+		if r.category != t.category {
+			continue
+		}
+
+		if t.channel > 0 {
+			return fmt.Sprintf("StatusSNS.ENERGY.%s[%d]", r.key, t.channel)
+		}
+
+		return "StatusSNS.ENERGY." + r.key
+	}
+
+	return ""
 }
 
-func (t *TasmotaDevice) LastValue() string {
-	return t.lastValue
+// energyValue returns the value of the category and channel of the device.
+func (t *TasmotaDevice) energyValue(tasmota *TasmotaEnergy) (float64, error) {
+	for _, r := range tasmotaReadings {
+		if r.category != t.category {
+			continue
+		}
+
+		value, err := r.field(tasmota).value(t.channel, r.average)
+
+		if err != nil {
+			return 0, err
+		}
+
+		t.setLastValue(fmt.Sprintf(r.format, value))
+		return value * r.factor, nil
+	}
+
+	return 0, errors.New(fmt.Sprintf("unknown category %s", t.category))
 }
 
 func readTasmotaName(netClient *http.Client, tasmota *TasmotaDevice) error {
@@ -201,63 +408,186 @@ func readTasmotaName(netClient *http.Client, tasmota *TasmotaDevice) error {
 	return nil
 }
 
+// The channels option of a plug selects how several channels or phases are
+// exported.
+const (
+	// TasmotaChannelsChannel exports each channel with a channel label.
+	TasmotaChannelsChannel = "channel"
+
+	// TasmotaChannelsPhase exports each channel with a phase label.
+	TasmotaChannelsPhase = "phase"
+
+	// TasmotaChannelsSum exports the sum of all channels.
+	TasmotaChannelsSum = "sum"
+)
+
 func LoadTasmotaDevices(ctx Context, devices *Devices, device Device) error {
 	duration, err := time.ParseDuration(device.Source.Interval)
 
 	if err != nil {
 		ctx.Warn(err, "cannot parse duration")
-		return nil
+		return err
 	}
 
 	if duration < 0 {
 		duration = 60
 	}
 
+	stale, err := parseStaleness(device)
+
+	if err != nil {
+		ctx.Warn(err, "cannot parse staleness")
+		return err
+	}
+
+	metrics := device.CategoryMetrics()
+
 	for _, d := range device.Source.Devices {
+		labels, err := newLabelSet(device.Source.Labels, d.Labels)
+
+		if err != nil {
+			ctx.Warn(err, "cannot parse labels")
+			return err
+		}
+
+		// the option is used as label name
+		switch d.Channels {
+		case "", TasmotaChannelsChannel, TasmotaChannelsPhase, TasmotaChannelsSum:
+		default:
+			err := fmt.Errorf("unknown channels '%s', expecting channel, phase or sum", d.Channels)
+			ctx.Warn(err, "cannot parse channels")
+			return err
+		}
+
 		energyUrl := fmt.Sprintf("http://%s/cm?cmnd=Status%%2010", d.Address)
 		statusUrl := fmt.Sprintf("http://%s/cm?cmnd=Status", d.Address)
 
-		energy := TasmotaDevice{
-			metric:    device.Source.EnergyMetric,
+		plug := TasmotaDevice{
 			name:      d.Name,
 			room:      d.Room,
-			category:  "energy",
 			address:   d.Address,
 			energyUrl: energyUrl,
 			statusUrl: statusUrl,
-			interval:  duration.Seconds(),
 		}
 
-		if len(energy.name) == 0 {
-			err := readTasmotaName(ctx.NetClient, &energy)
+		// a plug, which cannot be asked for its name, channels or sensors,
+		// is pending: it exports a single series per category named by its
+		// address without values, until it answers and the setup has been
+		// loaded again
+		if len(plug.name) == 0 {
+			err := readTasmotaName(ctx.NetClient, &plug)
 
 			if err == nil {
-				ctx.PushFields(logrus.Fields{"name": energy.name, "room": energy.room})
+				ctx.PushFields(logrus.Fields{"name": plug.name, "room": plug.room})
 				ctx.Info("found device")
 				ctx.Pop()
 			} else {
 				ctx.Warn(err, "cannot read name")
+				plug.name = d.Address
+				plug.pending = true
+			}
+		}
+
+		// the channels and sensors are taken from the first answer
+		var status *TasmotaEnergy
+		split := d.Channels != TasmotaChannelsSum
+
+		if !plug.pending && (split || len(device.Source.Sensors) > 0) {
+			if status, err = plug.readEnergy(ctx); err != nil {
+				ctx.Warn(err, "cannot read channels and sensors")
+				plug.pending = true
+			}
+		}
+
+		if plug.pending {
+			devices.incomplete = true
+
+			ctx.PushFields(logrus.Fields{"name": plug.name, "room": plug.room})
+			ctx.Info("found pending device")
+			ctx.Pop()
+		}
+
+		label := d.Channels
+
+		if label == "" {
+			label = TasmotaChannelsChannel
+		}
+
+		for _, r := range tasmotaReadings {
+			if metrics[r.category] == "" {
 				continue
 			}
+
+			first, last := 0, 0
+
+			if split && status != nil && len(r.field(status)) > 1 {
+				first, last = 1, len(r.field(status))
+			}
+
+			for channel := first; channel <= last; channel++ {
+				channelLabels := labels
+
+				if channel > 0 {
+					channelLabels = labels.with(label, strconv.Itoa(channel))
+				}
+
+				reading := TasmotaDevice{
+					metric:      metrics[r.category],
+					name:        plug.name,
+					room:        plug.room,
+					category:    r.category,
+					address:     d.Address,
+					channel:     channel,
+					energyUrl:   energyUrl,
+					statusUrl:   statusUrl,
+					interval:    duration.Seconds(),
+					pending:     plug.pending,
+					staleConfig: staleConfig{stale},
+					labelSet:    channelLabels,
+				}
+
+				devices.addDevice(&reading)
+			}
 		}
 
-		if device.Source.EnergyMetric != "" {
-			devices.addDevice(&energy)
+		if status == nil {
+			continue
 		}
 
-		if device.Source.PowerMetric != "" {
-			power := TasmotaDevice{
-				metric:    device.Source.PowerMetric,
-				name:      energy.name,
-				room:      energy.room,
-				category:  "power",
-				address:   d.Address,
-				energyUrl: energy.energyUrl,
-				statusUrl: energy.statusUrl,
-				interval:  energy.interval,
+		for _, sensor := range selectTasmotaSensors(status.sensors, device.Source.Sensors) {
+			sensorLabels := labels.with("sensor", sensor)
+			s := status.sensors[sensor]
+
+			for _, category := range tasmotaSensorCategories {
+				if metrics[category] == "" {
+					continue
+				}
+
+				// only the readings reported by the sensor are exported
+				if value, _, _ := s.reading(category, status); value == nil {
+					continue
+				}
+
+				reading := TasmotaDevice{
+					metric:      metrics[category],
+					name:        plug.name,
+					room:        plug.room,
+					category:    category,
+					address:     d.Address,
+					sensor:      sensor,
+					energyUrl:   energyUrl,
+					statusUrl:   statusUrl,
+					interval:    duration.Seconds(),
+					staleConfig: staleConfig{stale},
+					labelSet:    sensorLabels,
+				}
+
+				devices.addDevice(&reading)
 			}
 
-			devices.addDevice(&power)
+			ctx.PushFields(logrus.Fields{"name": plug.name, "sensor": sensor})
+			ctx.Info("found sensor")
+			ctx.Pop()
 		}
 	}
 
@@ -0,0 +1,178 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tasmotaSensor holds the readings of a sensor in StatusSNS. Sensors of the
+// same type are numbered, e.g. "DS18B20-1" and "DS18B20-2".
+type tasmotaSensor struct {
+	Temperature   *float64 `json:"Temperature"`
+	Humidity      *float64 `json:"Humidity"`
+	Pressure      *float64 `json:"Pressure"`
+	CarbonDioxide *float64 `json:"CarbonDioxide"`
+	Illuminance   *float64 `json:"Illuminance"`
+}
+
+// tasmotaSensorCategories lists the categories read from sensors in the
+// order the devices of a sensor are created.
+var tasmotaSensorCategories = []string{"temperature", "humidity", "pressure", "co2", "light"}
+
+// tasmotaSensorKeys maps the categories to the keys reported by a sensor.
+var tasmotaSensorKeys = map[string]string{
+	"temperature": "Temperature",
+	"humidity":    "Humidity",
+	"pressure":    "Pressure",
+	"co2":         "CarbonDioxide",
+	"light":       "Illuminance",
+}
+
+// parseTasmotaSensors returns all objects of StatusSNS besides ENERGY by
+// name. Values which are no objects, like Time and TempUnit, are skipped.
+func parseTasmotaSensors(body []byte) map[string]tasmotaSensor {
+	status := struct {
+		StatusSNS map[string]json.RawMessage `json:"StatusSNS"`
+	}{}
+
+	sensors := make(map[string]tasmotaSensor)
+
+	if json.Unmarshal(body, &status) != nil {
+		return sensors
+	}
+
+	for name, raw := range status.StatusSNS {
+		sensor := tasmotaSensor{}
+
+		if name == "ENERGY" || json.Unmarshal(raw, &sensor) != nil {
+			continue
+		}
+
+		sensors[name] = sensor
+	}
+
+	return sensors
+}
+
+// tasmotaSensorType returns the type of a sensor, i.e. its name without
+// the number.
+func tasmotaSensorType(name string) string {
+	if i := strings.LastIndex(name, "-"); i > 0 {
+		return name[:i]
+	}
+
+	return name
+}
+
+// selectTasmotaSensors returns the names of the sensors, whose type is
+// selected, in alphabetical order.
+func selectTasmotaSensors(sensors map[string]tasmotaSensor, types []string) []string {
+	selected := make(map[string]bool)
+
+	for _, t := range types {
+		selected[strings.ToUpper(t)] = true
+	}
+
+	names := make([]string, 0)
+
+	for name := range sensors {
+		if selected[strings.ToUpper(tasmotaSensorType(name))] {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// reading returns the value of a category and its unit. Temperatures are
+// converted to °C and pressures to hPa.
+func (s *tasmotaSensor) reading(category string, tasmota *TasmotaEnergy) (*float64, string, error) {
+	switch category {
+	case "temperature":
+		if s.Temperature == nil || tasmota.StatusSNS.TempUnit != "F" {
+			return s.Temperature, "°C", nil
+		}
+
+		value := (*s.Temperature - 32) * 5 / 9
+		return &value, "°C", nil
+	case "humidity":
+		return s.Humidity, "%", nil
+	case "pressure":
+		if s.Pressure == nil {
+			return nil, "hPa", nil
+		}
+
+		factor, ok := tasmotaPressureUnits[tasmota.StatusSNS.PressureUnit]
+
+		if !ok {
+			return nil, "hPa", fmt.Errorf("unknown pressure unit %s", tasmota.StatusSNS.PressureUnit)
+		}
+
+		value := *s.Pressure * factor
+		return &value, "hPa", nil
+	case "co2":
+		return s.CarbonDioxide, "ppm", nil
+	case "light":
+		return s.Illuminance, "lx", nil
+	default:
+		return nil, "", fmt.Errorf("unknown category %s", category)
+	}
+}
+
+// tasmotaPressureUnits converts the pressure units of Tasmota to hPa.
+var tasmotaPressureUnits = map[string]float64{
+	"":     1,
+	"hPa":  1,
+	"mmHg": 1.33322,
+	"inHg": 33.8639,
+}
+
+// sensorValue returns the value of the category of the sensor of the device.
+func (t *TasmotaDevice) sensorValue(tasmota *TasmotaEnergy) (float64, error) {
+	sensor, ok := tasmota.sensors[t.sensor]
+
+	if !ok {
+		return 0, &ParseError{Err: fmt.Errorf("no sensor %s", t.sensor)}
+	}
+
+	value, unit, err := sensor.reading(t.category, tasmota)
+
+	if err != nil {
+		return 0, &ParseError{Err: err}
+	}
+
+	if value == nil {
+		return 0, &ParseError{Err: fmt.Errorf("no %s reported by sensor %s", t.category, t.sensor)}
+	}
+
+	t.setLastValue(fmt.Sprintf("%.1f %s", *value, unit))
+	return *value, nil
+}
@@ -0,0 +1,193 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package devices
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// tasmotaPlug answers like a plug with two channels, which is offline until
+// online is set.
+func tasmotaPlug(t *testing.T, online *int32) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(online) == 0 {
+			http.Error(w, "offline", http.StatusServiceUnavailable)
+			return
+		}
+
+		switch r.URL.Query().Get("cmnd") {
+		case "Status":
+			w.Write([]byte(`{"Status":{"DeviceName":"Kueche","FriendlyName":["Kueche"]}}`))
+		case "Status 10":
+			w.Write([]byte(`{"StatusSNS":{"ENERGY":{"Power":[40,2]},"DS18B20":{"Id":"01","Temperature":21.5}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func loadTasmotaTest(t *testing.T, source string) (*Devices, error) {
+	device := Device{}
+
+	if err := yaml.Unmarshal([]byte(source), &device); err != nil {
+		t.Fatal(err)
+	}
+
+	devs := &Devices{ByDID: make(map[string]DeviceList)}
+	devs.Devices = new([]DeviceInterface)
+	ctx := Context{NetClient: http.DefaultClient, Clog: logrus.WithField("test", t.Name())}
+
+	return devs, LoadTasmotaDevices(ctx, devs, device)
+}
+
+func tasmotaSource(address string, labels string) string {
+	return `
+source:
+  provider: tasmota
+  power_metric: power_watt
+  temperature_metric: temperature_celsius
+  sensors:
+    - DS18B20
+  interval: 60s
+  devices:
+    - address: ` + address + `
+      channels: phase
+      labels:
+        circuit: F3` + labels + `
+`
+}
+
+func TestTasmotaChannelsAndSensors(t *testing.T) {
+	online := int32(1)
+	plug := tasmotaPlug(t, &online)
+	devs, err := loadTasmotaTest(t, tasmotaSource(plug.Listener.Addr().String(), ""))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if devs.Incomplete() {
+		t.Error("a plug, which answers, should be loaded completely")
+	}
+
+	labels := make([]string, 0)
+
+	for _, d := range *devs.Devices {
+		labels = append(labels, d.MetricName()+strings.Join(d.Labels(), ","))
+	}
+
+	expected := []string{
+		"power_watttasmota,Kueche,,F3,1",
+		"power_watttasmota,Kueche,,F3,2",
+		"temperature_celsiustasmota,Kueche,,F3,DS18B20",
+	}
+
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected %v, got %v", expected, labels)
+	}
+}
+
+func TestTasmotaReservedLabels(t *testing.T) {
+	for _, name := range []string{"channel", "phase", "sensor"} {
+		_, err := loadTasmotaTest(t, tasmotaSource("127.0.0.1:1", "\n        "+name+": x"))
+
+		if err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Errorf("expected label name '%s' to be reserved, got %v", name, err)
+		}
+	}
+}
+
+func TestTasmotaUnknownChannels(t *testing.T) {
+	for _, channels := range []string{"name", "room", "circuit", "a-b"} {
+		source := strings.Replace(tasmotaSource("127.0.0.1:1", ""), "channels: phase", "channels: "+channels, 1)
+		_, err := loadTasmotaTest(t, source)
+
+		if err == nil || !strings.Contains(err.Error(), "unknown channels") {
+			t.Errorf("expected channels '%s' to be rejected, got %v", channels, err)
+		}
+	}
+}
+
+func TestTasmotaPending(t *testing.T) {
+	online := int32(0)
+	plug := tasmotaPlug(t, &online)
+	address := plug.Listener.Addr().String()
+	devs, err := loadTasmotaTest(t, tasmotaSource(address, ""))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !devs.Incomplete() || len(*devs.Devices) != 1 {
+		t.Fatalf("expected a single pending device in an incomplete setup, got %d", len(*devs.Devices))
+	}
+
+	pending := (*devs.Devices)[0].(*TasmotaDevice)
+
+	if pending.Name() != address || pending.Datapoint() != "pending discovery" {
+		t.Errorf("unexpected pending device %s at %s", pending.Name(), pending.Datapoint())
+	}
+
+	drainReloads()
+	ctx := Context{NetClient: http.DefaultClient, Clog: logrus.WithField("test", t.Name())}
+
+	if _, err := pending.CurrentValue(ctx); err == nil || drainReloads() != "" {
+		t.Errorf("an offline plug should fail without loading the setup again, got %v", err)
+	}
+
+	atomic.StoreInt32(&online, 1)
+
+	if _, err := pending.CurrentValue(ctx); err != errTasmotaPending {
+		t.Errorf("expected no value until the setup has been loaded again, got %v", err)
+	}
+
+	if reason := drainReloads(); reason != "tasmota "+address+" available" {
+		t.Errorf("expected a reload request, got '%s'", reason)
+	}
+
+	// loading again discovers the channels and sensors
+	if devs, err = loadTasmotaTest(t, tasmotaSource(address, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	if devs.Incomplete() || len(*devs.Devices) != 3 {
+		t.Fatalf("expected the channels and the sensor after loading again, got %d devices", len(*devs.Devices))
+	}
+
+	if datapoint := (*devs.Devices)[2].(*TasmotaDevice).Datapoint(); datapoint != "StatusSNS.DS18B20.Temperature" {
+		t.Errorf("expected the sensor, got %s", datapoint)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package devices
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// xmlrpcValue is a value of an XML-RPC call or response. A value without a
+// type element is a string.
+type xmlrpcValue struct {
+	Text    string        `xml:",chardata"`
+	String  *string       `xml:"string"`
+	Int     *string       `xml:"int"`
+	I4      *string       `xml:"i4"`
+	Boolean *string       `xml:"boolean"`
+	Double  *string       `xml:"double"`
+	Base64  *string       `xml:"base64"`
+	Nil     *struct{}     `xml:"nil"`
+	Array   *xmlrpcArray  `xml:"array"`
+	Struct  *xmlrpcStruct `xml:"struct"`
+}
+
+type xmlrpcArray struct {
+	Values []xmlrpcValue `xml:"data>value"`
+}
+
+type xmlrpcStruct struct {
+	Members []struct {
+		Name  string      `xml:"name"`
+		Value xmlrpcValue `xml:"value"`
+	} `xml:"member"`
+}
+
+type xmlrpcMethodCall struct {
+	XMLName    xml.Name      `xml:"methodCall"`
+	MethodName string        `xml:"methodName"`
+	Params     []xmlrpcValue `xml:"params>param>value"`
+}
+
+type xmlrpcMethodResponse struct {
+	XMLName xml.Name      `xml:"methodResponse"`
+	Params  []xmlrpcValue `xml:"params>param>value"`
+	Fault   *xmlrpcValue  `xml:"fault>value"`
+}
+
+// XmlRpcFault is returned, when an XML-RPC server answers with a fault.
+type XmlRpcFault struct {
+	Method string
+	Code   int
+	Text   string
+}
+
+func (f *XmlRpcFault) Error() string {
+	return fmt.Sprintf("%s failed with fault %d: %s", f.Method, f.Code, f.Text)
+}
+
+// decode converts a value into string, int64, bool, float64, []interface{},
+// map[string]interface{} or nil.
+func (v *xmlrpcValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil:
+		return strconv.ParseInt(strings.TrimSpace(*v.Int), 10, 64)
+	case v.I4 != nil:
+		return strconv.ParseInt(strings.TrimSpace(*v.I4), 10, 64)
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.Base64 != nil:
+		return strings.TrimSpace(*v.Base64), nil
+	case v.Nil != nil:
+		return nil, nil
+	case v.Array != nil:
+		values := make([]interface{}, len(v.Array.Values))
+
+		for i := range v.Array.Values {
+			value, err := v.Array.Values[i].decode()
+
+			if err != nil {
+				return nil, err
+			}
+
+			values[i] = value
+		}
+
+		return values, nil
+	case v.Struct != nil:
+		members := make(map[string]interface{}, len(v.Struct.Members))
+
+		for i := range v.Struct.Members {
+			value, err := v.Struct.Members[i].Value.decode()
+
+			if err != nil {
+				return nil, err
+			}
+
+			members[v.Struct.Members[i].Name] = value
+		}
+
+		return members, nil
+	default:
+		return v.Text, nil
+	}
+}
+
+// writeXmlRpcValue encodes a value. Maps are written with sorted keys.
+func writeXmlRpcValue(w *bytes.Buffer, value interface{}) {
+	w.WriteString("<value>")
+
+	switch v := value.(type) {
+	case nil:
+		w.WriteString("<nil/>")
+	case string:
+		w.WriteString("<string>")
+		xml.EscapeText(w, []byte(v))
+		w.WriteString("</string>")
+	case int:
+		fmt.Fprintf(w, "<i4>%d</i4>", v)
+	case int64:
+		fmt.Fprintf(w, "<i4>%d</i4>", v)
+	case bool:
+		if v {
+			w.WriteString("<boolean>1</boolean>")
+		} else {
+			w.WriteString("<boolean>0</boolean>")
+		}
+	case float64:
+		fmt.Fprintf(w, "<double>%s</double>", strconv.FormatFloat(v, 'f', -1, 64))
+	case []interface{}:
+		w.WriteString("<array><data>")
+
+		for _, e := range v {
+			writeXmlRpcValue(w, e)
+		}
+
+		w.WriteString("</data></array>")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		w.WriteString("<struct>")
+
+		for _, k := range keys {
+			w.WriteString("<member><name>")
+			xml.EscapeText(w, []byte(k))
+			w.WriteString("</name>")
+			writeXmlRpcValue(w, v[k])
+			w.WriteString("</member>")
+		}
+
+		w.WriteString("</struct>")
+	default:
+		w.WriteString("<string>")
+		xml.EscapeText(w, []byte(fmt.Sprint(v)))
+		w.WriteString("</string>")
+	}
+
+	w.WriteString("</value>")
+}
+
+func writeXmlRpcCall(method string, params ...interface{}) []byte {
+	w := bytes.NewBufferString(`<?xml version="1.0"?><methodCall><methodName>`)
+	xml.EscapeText(w, []byte(method))
+	w.WriteString("</methodName><params>")
+
+	for _, p := range params {
+		w.WriteString("<param>")
+		writeXmlRpcValue(w, p)
+		w.WriteString("</param>")
+	}
+
+	w.WriteString("</params></methodCall>")
+	return w.Bytes()
+}
+
+func writeXmlRpcResponse(result interface{}) []byte {
+	w := bytes.NewBufferString(`<?xml version="1.0"?><methodResponse><params><param>`)
+	writeXmlRpcValue(w, result)
+	w.WriteString("</param></params></methodResponse>")
+	return w.Bytes()
+}
+
+func writeXmlRpcFault(code int, text string) []byte {
+	w := bytes.NewBufferString(`<?xml version="1.0"?><methodResponse><fault>`)
+	writeXmlRpcValue(w, map[string]interface{}{"faultCode": code, "faultString": text})
+	w.WriteString("</fault></methodResponse>")
+	return w.Bytes()
+}
+
+// callXmlRpc invokes a method of an XML-RPC server and returns the decoded
+// result.
+func callXmlRpc(ctx Context, client *http.Client, url string, userName string, password string,
+	method string, params ...interface{}) (interface{}, error) {
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(writeXmlRpcCall(method, params...)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "text/xml")
+
+	if userName != "" {
+		req.SetBasicAuth(userName, password)
+	}
+
+	response, err := client.Do(req)
+
+	if err != nil {
+		return nil, &HomematicError{Kind: HomematicUnavailable, Err: err}
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, homematicStatusError(url, response.StatusCode)
+	}
+
+	body, err := io.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, &HomematicError{Kind: HomematicUnavailable, Err: err}
+	}
+
+	answer := xmlrpcMethodResponse{}
+
+	if err = parseXml(ctx, body, &answer); err != nil {
+		return nil, &ParseError{Err: err}
+	}
+
+	if answer.Fault != nil {
+		fault, _ := answer.Fault.decode()
+		members, _ := fault.(map[string]interface{})
+		code, _ := members["faultCode"].(int64)
+		text, _ := members["faultString"].(string)
+
+		return nil, &XmlRpcFault{Method: method, Code: int(code), Text: text}
+	}
+
+	if len(answer.Params) == 0 {
+		return nil, nil
+	}
+
+	return answer.Params[0].decode()
+}
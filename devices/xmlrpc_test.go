@@ -0,0 +1,174 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package devices
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func xmlRpcTestContext(t *testing.T) Context {
+	return Context{NetClient: http.DefaultClient, Clog: logrus.WithField("test", t.Name())}
+}
+
+func TestXmlRpcRoundTrip(t *testing.T) {
+	ctx := xmlRpcTestContext(t)
+
+	params := []interface{}{
+		"<Küche & Bad>",
+		int64(-42),
+		true,
+		false,
+		1.25,
+		nil,
+		[]interface{}{"a", int64(1), []interface{}{}},
+		map[string]interface{}{"ADDRESS": "LEQ0535163:1", "VERSION": int64(3), "FLAGS": map[string]interface{}{}},
+	}
+
+	call := xmlrpcMethodCall{}
+
+	if err := parseXml(ctx, writeXmlRpcCall("event", params...), &call); err != nil {
+		t.Fatal(err)
+	}
+
+	if call.MethodName != "event" || len(call.Params) != len(params) {
+		t.Fatalf("unexpected call %s with %d params", call.MethodName, len(call.Params))
+	}
+
+	for i := range params {
+		value, err := call.Params[i].decode()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(value, params[i]) {
+			t.Errorf("expected %#v, got %#v", params[i], value)
+		}
+	}
+}
+
+func TestXmlRpcDecodeUntyped(t *testing.T) {
+	ctx := xmlRpcTestContext(t)
+	call := xmlrpcMethodCall{}
+	body := `<?xml version="1.0"?><methodCall><methodName>event</methodName><params>` +
+		`<param><value>untyped</value></param><param><value><int> 7 </int></value></param>` +
+		`<param><value><double>x</double></value></param></params></methodCall>`
+
+	if err := parseXml(ctx, []byte(body), &call); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := call.Params[0].decode(); err != nil || value != "untyped" {
+		t.Errorf("expected a string, got %#v, %v", value, err)
+	}
+
+	if value, err := call.Params[1].decode(); err != nil || value != int64(7) {
+		t.Errorf("expected 7, got %#v, %v", value, err)
+	}
+
+	if _, err := call.Params[2].decode(); err == nil {
+		t.Error("expected an error for an invalid double")
+	}
+}
+
+// xmlRpcServer answers every call with the response written by answer.
+func xmlRpcServer(t *testing.T, answer func(call xmlrpcMethodCall, params []interface{}) []byte) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		call := xmlrpcMethodCall{}
+
+		if err := parseXml(xmlRpcTestContext(t), body, &call); err != nil {
+			t.Error(err)
+		}
+
+		params := make([]interface{}, len(call.Params))
+
+		for i := range call.Params {
+			params[i], _ = call.Params[i].decode()
+		}
+
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write(answer(call, params))
+	}))
+
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestXmlRpcCall(t *testing.T) {
+	ts := xmlRpcServer(t, func(call xmlrpcMethodCall, params []interface{}) []byte {
+		return writeXmlRpcResponse([]interface{}{call.MethodName, params})
+	})
+
+	result, err := callXmlRpc(xmlRpcTestContext(t), ts.Client(), ts.URL, "", "", "init", "http://host:9877", "id-1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{"init", []interface{}{"http://host:9877", "id-1"}}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %#v, got %#v", expected, result)
+	}
+}
+
+func TestXmlRpcFault(t *testing.T) {
+	ts := xmlRpcServer(t, func(call xmlrpcMethodCall, params []interface{}) []byte {
+		return writeXmlRpcFault(-2, "Unknown instance <"+call.MethodName+">")
+	})
+
+	_, err := callXmlRpc(xmlRpcTestContext(t), ts.Client(), ts.URL, "", "", "init", "http://host:9877")
+
+	var fault *XmlRpcFault
+
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected a fault, got %v", err)
+	}
+
+	if fault.Method != "init" || fault.Code != -2 || fault.Text != "Unknown instance <init>" {
+		t.Errorf("unexpected fault %#v", fault)
+	}
+}
+
+func TestXmlRpcStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	_, err := callXmlRpc(xmlRpcTestContext(t), ts.Client(), ts.URL, "Admin", "wrong", "init")
+
+	if !IsAuthError(err) {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+)
+
+const (
+	errorTimeout       = "timeout"
+	errorHttpStatus    = "http_status"
+	errorParse         = "parse"
+	errorConnection    = "connection"
+	errorAuth          = "auth"
+	errorUnavailable   = "unavailable"
+	errorScript        = "script"
+	errorUnknownObject = "unknown_object"
+	errorOther         = "other"
+)
+
+var errorKinds = []string{
+	errorTimeout, errorHttpStatus, errorParse, errorConnection, errorAuth, errorUnavailable, errorScript,
+	errorUnknownObject, errorOther,
+}
+
+// Health describes how well a series could be read recently.
+type Health struct {
+	Duration    time.Duration
+	Errors      map[string]float64
+	LastSuccess time.Time
+	Up          bool
+
+	// Suspended is set, if the device is no longer polled, because its
+	// credentials have been rejected. Polling resumes after a reload.
+	Suspended bool
+}
+
+// errorKind classifies an error. The errors of a CCU are classified by
+// their kind, so that a CCU, which is not available, can be told apart from
+// a datapoint, which does not exist.
+func errorKind(err error) string {
+	var netErr net.Error
+	var statusErr *devices.StatusError
+	var parseErr *devices.ParseError
+	var hmErr *devices.HomematicError
+
+	if errors.As(err, &hmErr) {
+		switch hmErr.Kind {
+		case devices.HomematicAuth:
+			return errorAuth
+		case devices.HomematicUnavailable:
+			return errorUnavailable
+		case devices.HomematicScript:
+			return errorScript
+		case devices.HomematicUnknownObject:
+			return errorUnknownObject
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorTimeout
+	}
+
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return errorTimeout
+		}
+
+		return errorConnection
+	}
+
+	if errors.As(err, &statusErr) {
+		return errorHttpStatus
+	}
+
+	if errors.As(err, &parseErr) {
+		return errorParse
+	}
+
+	return errorOther
+}
@@ -0,0 +1,68 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/fceller/home2grafana/devices"
+)
+
+func TestErrorKind(t *testing.T) {
+	timeout := &net.DNSError{Err: "timeout", IsTimeout: true}
+	refused := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	status := &devices.StatusError{Url: "http://plug", StatusCode: 500}
+
+	homematic := func(kind devices.HomematicErrorKind, err error) error {
+		return fmt.Errorf("read: %w", &devices.HomematicError{Kind: kind, Err: err})
+	}
+
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{timeout, errorTimeout},
+		{context.DeadlineExceeded, errorTimeout},
+		{refused, errorConnection},
+		{status, errorHttpStatus},
+		{&devices.ParseError{Err: errors.New("no number")}, errorParse},
+		{errors.New("unexpected"), errorOther},
+		{homematic(devices.HomematicAuth, status), errorAuth},
+		{homematic(devices.HomematicUnavailable, timeout), errorUnavailable},
+		{homematic(devices.HomematicUnavailable, refused), errorUnavailable},
+		{homematic(devices.HomematicScript, errors.New("syntax error")), errorScript},
+		{homematic(devices.HomematicUnknownObject, errors.New("unknown datapoint")), errorUnknownObject},
+	}
+
+	for _, test := range tests {
+		if kind := errorKind(test.err); kind != test.kind {
+			t.Errorf("%v: expected %s, got %s", test.err, test.kind, kind)
+		}
+	}
+}
@@ -26,15 +26,17 @@
 package main
 
 import (
-	"container/heap"
 	"flag"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"net/http"
@@ -48,13 +50,20 @@ import (
 )
 
 type DeviceItem struct {
-	methods  devices.DeviceInterface
-	last     float64
-	lastRate float64
-	time     int64
-	timeRate int64
-	expiry   int64
-	index    int
+	methods   devices.DeviceInterface
+	last      float64
+	lastRate  float64
+	total     float64
+	resets    float64
+	errors    map[string]float64
+	success   time.Time
+	stale     bool
+	suspended bool
+	rate      float64
+	time      int64
+	timeRate  int64
+	expiry    int64
+	index     int
 }
 
 type PriorityQueue []*DeviceItem
@@ -89,196 +98,333 @@ func (pq PriorityQueue) Swap(i, j int) {
 	pq[j].index = j
 }
 
-var prometheusGauges = make(map[string]*prometheus.GaugeVec)
-var prometheusCounters = make(map[string]*prometheus.CounterVec)
 var registry *prometheus.Registry
 
-const totalSuffix = "total"
-const rateSuffix = "rate"
+// readDevice reads the current value of a device without holding any lock
+// and publishes the result to the store. It returns the factor by which the
+// next poll should be delayed.
+func readDevice(ctx devices.Context, store *Store, d *DeviceItem) uint64 {
+	start := time.Now()
+	value, err := d.methods.CurrentValue(ctx)
 
-var SyncPoint sync.Mutex
+	return recordValue(ctx, store, d, value, err, start, time.Since(start))
+}
 
-func setPrometheusValue(ctx devices.Context, d *DeviceItem) uint64 {
-	SyncPoint.Lock()
-	defer SyncPoint.Unlock()
+// recordValue publishes the result of reading a device, which started at
+// start and took duration, to the store. It returns the factor by which the
+// next poll should be delayed.
+func recordValue(ctx devices.Context, store *Store, d *DeviceItem, value float64, err error,
+	start time.Time, duration time.Duration) uint64 {
 
 	category := d.methods.CategoryName()
-	name := d.methods.MetricName()
-	value, err := d.methods.CurrentValue(ctx)
+
+	if err != nil {
+		d.errors[errorKind(err)]++
+	} else {
+		d.success = start
+	}
+
+	errs := make(map[string]float64, len(d.errors))
+
+	for k, v := range d.errors {
+		errs[k] = v
+	}
+
+	if devices.IsAuthError(err) {
+		d.suspended = true
+	}
+
+	store.SetHealth(d.methods, Health{
+		Duration:    duration,
+		Errors:      errs,
+		LastSuccess: d.success,
+		Up:          err == nil,
+		Suspended:   d.suspended,
+	})
 
 	if err == nil {
 		ctx.PushField(category, value)
 		ctx.Info(fmt.Sprintf("read %s: %f", category, value))
 		ctx.Pop()
 
-		prometheusGauges[name].WithLabelValues(d.methods.Labels()...).Set(value)
-		//d.methods.lastStr = fmt.Sprintf("%.2f", value)
-
-		if category == "energy" {
-			counter := fmt.Sprintf("%s_%s", name, totalSuffix)
-			now := time.Now().UnixMilli()
-
-			if !math.IsNaN(d.last) {
-				if value >= d.last {
-					prometheusCounters[counter].WithLabelValues(d.methods.Labels()...).Add(value - d.last)
-				} else {
-					registry.Unregister(prometheusCounters[counter])
-					prometheusCounters[counter] = prometheus.NewCounterVec(prometheus.CounterOpts{
-						Name: counter,
-						Help: name,
-					}, []string{"provider", "name", "room"})
-				}
+		// all values of a batch share the time their read has finished
+		recordReading(ctx, store, d, value, start.Add(duration))
+		return 1
+	} else {
+		ctx.Warn(err, fmt.Sprintf("cannot read %s total", category))
+
+		// while the last value is still valid, retry at the normal interval
+		// so that a short outage does not turn the series stale
+		if after := d.methods.Stale().After; after > 0 && !d.success.IsZero() {
+			if time.Since(d.success) < after {
+				return 1
+			}
+
+			if !d.stale {
+				ctx.Warn(err, fmt.Sprintf("%s is stale", category))
 			}
 
-			d.last = value
-			d.time = now
-
-			if !math.IsNaN(d.lastRate) {
-				if value > d.lastRate && now > d.timeRate {
-					avg := fmt.Sprintf("%s_%s", name, rateSuffix)
-					computed := (value - d.lastRate) / float64(now-d.timeRate) * 1000
-					prometheusGauges[avg].WithLabelValues(d.methods.Labels()...).Set(computed)
-					d.lastRate = value
-					d.timeRate = now
-				} else if value < d.lastRate {
-					d.lastRate = value
-					d.timeRate = now
-				}
+			d.stale = true
+		}
+
+		return 5
+	}
+}
+
+// recordReading publishes a value read at now and accumulates the counters
+// of an energy series.
+func recordReading(ctx devices.Context, store *Store, d *DeviceItem, value float64, now time.Time) {
+	d.stale = false
+
+	if d.methods.CategoryName() == "energy" {
+		nowMs := now.UnixMilli()
+
+		if !math.IsNaN(d.last) {
+			if value >= d.last {
+				d.total += value - d.last
 			} else {
+				// the meter has been reset or has overflown, it started
+				// again at zero and has counted up to the current value
+				d.total += value
+				d.resets++
+
+				ctx.PushFields(logrus.Fields{"last": d.last, "current": value})
+				ctx.Info("detected counter reset")
+				ctx.Pop()
+			}
+		}
+
+		d.last = value
+		d.time = nowMs
+
+		if !math.IsNaN(d.lastRate) {
+			if value > d.lastRate && nowMs > d.timeRate {
+				d.rate = (value - d.lastRate) / float64(nowMs-d.timeRate) * 1000
 				d.lastRate = value
-				d.timeRate = now
+				d.timeRate = nowMs
+			} else if value < d.lastRate {
+				d.lastRate = value
+				d.timeRate = nowMs
 			}
+		} else {
+			d.lastRate = value
+			d.timeRate = nowMs
 		}
+	}
 
-		return 1
-	} else {
-		ctx.Warn(err, fmt.Sprintf("cannot read %s total", category))
-		return 5
+	store.Set(d.methods, Reading{
+		Value:  value,
+		Text:   d.methods.LastValue(),
+		Time:   now,
+		Total:  d.total,
+		Resets: d.resets,
+		Rate:   d.rate,
+	})
+}
+
+// recordPushed publishes a value pushed by a device at the given time. Only
+// the value and the time of the latest success change, the duration and the
+// errors are those of the latest poll.
+func recordPushed(ctx devices.Context, store *Store, d *DeviceItem, value float64, at time.Time) {
+	d.success = at
+
+	if h, ok := store.GetHealth(d.methods); ok {
+		h.LastSuccess = at
+		store.SetHealth(d.methods, h)
 	}
+
+	ctx.PushField(d.methods.CategoryName(), value)
+	ctx.Info(fmt.Sprintf("pushed %s: %f", d.methods.CategoryName(), value))
+	ctx.Pop()
+
+	recordReading(ctx, store, d, value, at)
 }
 
-func readData(d *devices.Devices) {
-	if d.IsEmpty() {
-		return
+func newDeviceItem(dev devices.DeviceInterface, state *State, now int64) *DeviceItem {
+	item := &DeviceItem{
+		methods:  dev,
+		last:     math.NaN(),
+		lastRate: math.NaN(),
+		rate:     math.NaN(),
+		errors:   make(map[string]float64),
+		time:     now,
+		timeRate: now,
+		expiry:   now/1000 + (500+rand.Int63n(501))*int64(dev.IntervalSec())/1000,
+		index:    -1,
 	}
 
-	ctx := devices.Context{
-		NetClient: &http.Client{Timeout: time.Second * 10},
-		Clog:      logrus.WithField("task", "read metrics"),
+	if state == nil {
+		return item
 	}
 
-	deviceHeap := make(PriorityQueue, d.Length())
-	now := time.Now().UnixMilli()
+	state.mu.Lock()
+	saved, ok := state.Series[seriesKey(dev)]
+	state.mu.Unlock()
+
+	if ok && dev.CategoryName() == "energy" {
+		item.last = saved.Last
+		item.time = saved.Time
+		item.lastRate = saved.Last
+		item.timeRate = saved.Time
+		item.total = saved.Total
+		item.resets = saved.Resets
+	}
 
-	for i, dev := range *d.Devices {
-		deviceHeap[i] = &DeviceItem{
-			methods:  dev,
-			last:     math.NaN(),
-			lastRate: math.NaN(),
-			time:     now,
-			timeRate: now,
-			expiry:   now/1000 + (500+rand.Int63n(501))*int64(dev.IntervalSec())/1000,
-			index:    i,
+	return item
+}
+
+// deviceSeries returns the devices, which export a metric, and the pending
+// devices, which export their health only. A device, which would export the
+// same series as an earlier device, is skipped, because Prometheus rejects a
+// scrape containing the same series twice.
+func deviceSeries(d *devices.Devices) []devices.DeviceInterface {
+	series := make([]devices.DeviceInterface, 0, d.Length())
+	seen := make(map[string]devices.DeviceInterface)
+
+	for _, dev := range *d.Devices {
+		if dev.MetricName() == "" && !devices.IsPending(dev) {
+			continue
 		}
-	}
 
-	heap.Init(&deviceHeap)
+		keys := []string{
+			seriesKey(dev),
+			fmt.Sprintf("%s%q%q", dev.MetricName(), dev.LabelNames(), dev.Labels()),
+		}
+
+		duplicate := false
 
-	for deviceHeap.Len() > 0 {
-		item := heap.Pop(&deviceHeap).(*DeviceItem)
-		sleep := int64(1)
+		for _, key := range keys {
+			if first, ok := seen[key]; ok {
+				logrus.WithFields(logrus.Fields{"device": dev.FullName(), "first": first.FullName()}).
+					Warn("skipping device exporting the same series as an earlier device")
+				duplicate = true
+				break
+			}
+		}
 
-		if now < item.expiry {
-			sleep = item.expiry - time.Now().Unix()
+		if duplicate {
+			continue
 		}
 
-		time.Sleep(time.Second * time.Duration(sleep))
+		for _, key := range keys {
+			seen[key] = dev
+		}
+
+		series = append(series, dev)
+	}
 
-		ctx.PushField("device", item.methods.LogName())
-		defer ctx.Pop()
+	return series
+}
 
-		factor := setPrometheusValue(ctx, item)
-		item.expiry = time.Now().Unix() + int64(item.methods.IntervalSec()*factor)
+func deviceItems(series []devices.DeviceInterface, state *State) []*DeviceItem {
+	now := time.Now().UnixMilli()
+	items := make([]*DeviceItem, 0, len(series))
 
-		heap.Push(&deviceHeap, item)
+	for _, dev := range series {
+		items = append(items, newDeviceItem(dev, state, now))
 	}
+
+	return items
 }
 
-var GlobalDevices devices.Devices
+var globalMu sync.RWMutex
+var GlobalDevices *devices.Devices
 var GlobalOverview *Overview
+var GlobalStore *Store
 
 func overviewHandler(writer http.ResponseWriter, request *http.Request) {
-	SyncPoint.Lock()
-	defer SyncPoint.Unlock()
-
 	details := request.URL.Query().Get("details")
 
-	GenerateOverview(writer, GlobalOverview, &GlobalDevices, details == "1")
+	globalMu.RLock()
+	overview := GlobalOverview
+	devs := GlobalDevices
+	globalMu.RUnlock()
+
+	GenerateOverview(writer, overview, devs, GlobalStore, details == "1")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[0], os.Args[2:], os.Stdout))
+		case "probe":
+			os.Exit(runProbe(os.Args[0], os.Args[2:], os.Stdout))
+		}
+	}
+
 	bind := ""
 	setup := ""
 	enableH2c := false
+	workers := 8
+	limitSpec := ""
+	stateDir := ""
+	stateInterval := time.Duration(0)
+	watchInterval := time.Duration(0)
+	timeout := time.Duration(0)
+	pushBind := ""
+	pushURL := ""
+	pushInterval := time.Duration(0)
 
 	flagset := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	flagset.StringVar(&bind, "bind", ":9876", "The socket to bind to.")
 	flagset.StringVar(&setup, "setup", "./setup", "The directory holding the device definitions.")
 	flagset.BoolVar(&enableH2c, "h2c", false, "Enable h2c (http/2 over tcp) protocol.")
+	flagset.IntVar(&workers, "workers", 8, "The maximal number of devices read in parallel.")
+	flagset.StringVar(&limitSpec, "limits", "homematic=2,iobroker=2,tasmota=1",
+		"The maximal number of parallel requests per endpoint and provider.")
+	flagset.StringVar(&stateDir, "state", "", "The directory holding the counter state, empty to disable.")
+	flagset.DurationVar(&stateInterval, "state-interval", 5*time.Minute, "How often the counter state is saved.")
+	flagset.DurationVar(&watchInterval, "watch", 0,
+		"How often the setup directory is checked for changes, 0 to reload only on SIGHUP.")
+	flagset.DurationVar(&timeout, "timeout", 10*time.Second, "The timeout for a single request to a device.")
+	flagset.StringVar(&pushBind, "push-bind", "",
+		"The socket receiving the events pushed by Homematic CCUs, empty to poll only.")
+	flagset.StringVar(&pushURL, "push-url", "",
+		"The url under which the CCUs reach the push socket, derived from -push-bind if empty.")
+	flagset.DurationVar(&pushInterval, "push-interval", 3*time.Minute,
+		"How often the CCUs are asked again to push events.")
 	flagset.Parse(os.Args[1:])
 
-	GlobalDevices = devices.LoadDevices(setup)
+	limits, err := ParseLimits(limitSpec)
 
-	if GlobalDevices.IsEmpty() {
-		logrus.Panic("no devices have been defined, exiting...")
+	if err != nil {
+		logrus.Panic(err)
 	}
 
-	registry = prometheus.NewRegistry()
-
-	for _, d := range *GlobalDevices.Devices {
-		name := d.MetricName()
-
-		if name != "" {
-			cat := d.CategoryName()
+	if stateInterval <= 0 {
+		logrus.Panic("-state-interval must be positive")
+	}
 
-			if _, prs := prometheusGauges[name]; !prs {
-				prometheusGauges[name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-					Name: name,
-					Help: name,
-				}, []string{"provider", "name", "room"})
+	if pushInterval <= 0 {
+		logrus.Panic("-push-interval must be positive")
+	}
 
-				registry.MustRegister(prometheusGauges[name])
-			}
+	client := &http.Client{Timeout: timeout}
+	devs := devices.LoadDevices(setup, client)
+	GlobalDevices = &devs
 
-			if cat == "energy" {
-				counter := fmt.Sprintf("%s_%s", name, totalSuffix)
+	if GlobalDevices.IsEmpty() && !GlobalDevices.Incomplete() {
+		logrus.Panic("no devices have been defined, exiting...")
+	}
 
-				if _, prs := prometheusCounters[counter]; !prs {
-					prometheusCounters[counter] = prometheus.NewCounterVec(prometheus.CounterOpts{
-						Name: counter,
-						Help: name,
-					}, []string{"provider", "name", "room"})
+	if GlobalDevices.Incomplete() {
+		logrus.Warn("some devices are not available, the setup is loaded again once they are")
+	}
 
-					registry.MustRegister(prometheusCounters[counter])
-				}
-			}
+	state, err := LoadState(stateDir)
 
-			if cat == "energy" {
-				avg := fmt.Sprintf("%s_%s", name, rateSuffix)
+	if err != nil {
+		logrus.Panic(err)
+	}
 
-				if _, prs := prometheusGauges[avg]; !prs {
-					prometheusGauges[avg] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-						Name: avg,
-						Help: name,
-					}, []string{"provider", "name", "room"})
+	series := deviceSeries(GlobalDevices)
+	GlobalStore = NewStore()
+	GlobalStore.Replace(series)
 
-					registry.MustRegister(prometheusGauges[avg])
-				}
-			}
-		}
-	}
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(GlobalStore))
 
-	var err error
 	GlobalOverview, err = LoadOverviewDesc(setup)
 
 	if err != nil {
@@ -290,7 +436,56 @@ func main() {
 	mux.HandleFunc("/index.html", overviewHandler)
 	mux.HandleFunc("/", overviewHandler)
 
-	go readData(&GlobalDevices)
+	ctx := devices.Context{
+		NetClient: client,
+		Clog:      logrus.WithField("task", "read metrics"),
+	}
+
+	scheduler := NewScheduler(ctx, GlobalStore, workers, limits)
+	go scheduler.Run(deviceItems(series, state))
+
+	reloader := &Reloader{setup: setup, client: client, state: state, scheduler: scheduler}
+
+	if pushBind != "" {
+		if pushURL == "" {
+			host, _, err := net.SplitHostPort(pushBind)
+
+			// the CCUs cannot reach an unspecified address like 0.0.0.0
+			if ip := net.ParseIP(host); err != nil || host == "" || (ip != nil && ip.IsUnspecified()) {
+				logrus.Panic("-push-url is required, unless -push-bind contains a host reachable by the CCUs")
+			}
+
+			pushURL = "http://" + pushBind
+		}
+
+		pushCtx := devices.Context{
+			NetClient: ctx.NetClient,
+			Clog:      logrus.WithField("task", "receive events"),
+		}
+
+		reloader.receiver = devices.NewHomematicReceiver(pushCtx, pushURL, scheduler.Push)
+
+		listener, err := net.Listen("tcp", pushBind)
+
+		if err != nil {
+			logrus.Panic(err)
+		}
+
+		logrus.Infof("start receiving events on %s", pushBind)
+		go func() { log.Fatal(http.Serve(listener, reloader.receiver)) }()
+
+		reloader.receiver.Register(GlobalDevices)
+		go reloader.receiver.Run(pushInterval)
+	} else if devices.UsesPush(GlobalDevices) {
+		logrus.Warn("push is enabled for a homematic source, but -push-bind is not set, polling only")
+	}
+
+	go reloader.handleSignals()
+	go reloader.handleReloadRequests()
+
+	if watchInterval > 0 {
+		go reloader.watch(watchInterval)
+	}
 
 	var srv *http.Server
 	if enableH2c {
@@ -299,6 +494,24 @@ func main() {
 		srv = &http.Server{Addr: bind, Handler: mux}
 	}
 
+	if stateDir != "" {
+		go saveStatePeriodically(stateDir, GlobalStore, state, stateInterval)
+
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+			sig := <-signals
+
+			logrus.Infof("received %s, saving state", sig)
+
+			if err := SaveState(stateDir, GlobalStore, state); err != nil {
+				logrus.WithError(err).Warn("cannot save state")
+			}
+
+			os.Exit(0)
+		}()
+	}
+
 	logrus.Infof("start listing on %s", bind)
 	log.Fatal(srv.ListenAndServe())
 }
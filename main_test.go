@@ -0,0 +1,99 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+)
+
+// TestCounterResets checks how the total of an energy series follows the
+// meter across resets.
+func TestCounterResets(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		total  float64
+		resets float64
+	}{
+		{"first reading", []float64{1200}, 0, 0},
+		{"counting", []float64{1200, 1250, 1250, 1300}, 100, 0},
+		{"drop to zero", []float64{1200, 1300, 0, 20}, 120, 1},
+		{"drop above zero", []float64{1200, 1300, 50}, 150, 1},
+		{"wrap", []float64{65500, 65535, 10, 40}, 75, 1},
+		{"restart twice", []float64{500, 600, 5, 700, 3}, 803, 2},
+	}
+
+	for _, test := range tests {
+		device := &fakeDevice{id: "meter", category: "energy", provider: "tasmota", endpoint: "plug"}
+		store := NewStore()
+		store.Replace([]devices.DeviceInterface{device})
+		item := newDeviceItem(device, nil, time.Now().UnixMilli())
+		start := time.Now()
+
+		for i, value := range test.values {
+			recordValue(testContext(t), store, item, value, nil, start.Add(time.Duration(i)*time.Minute), 0)
+		}
+
+		r, _ := store.Get(device)
+
+		if r.Total != test.total || r.Resets != test.resets || r.Value != test.values[len(test.values)-1] {
+			t.Errorf("%s: expected total %v and %v resets, got %+v", test.name, test.total, test.resets, r)
+		}
+	}
+}
+
+// TestCounterContinuesFromState checks that a series restored from the
+// state counts on from the persisted total, including a reset while the
+// process was not running.
+func TestCounterContinuesFromState(t *testing.T) {
+	device := &fakeDevice{id: "meter", category: "energy", provider: "tasmota", endpoint: "plug"}
+	state := &State{Series: map[string]SeriesState{seriesKey(device): {Last: 1300, Time: 1000, Total: 500, Resets: 1}}}
+
+	tests := []struct {
+		value  float64
+		total  float64
+		resets float64
+	}{
+		{1350, 550, 1},
+		{40, 540, 2},
+	}
+
+	for _, test := range tests {
+		store := NewStore()
+		store.Replace([]devices.DeviceInterface{device})
+		item := newDeviceItem(device, state, time.Now().UnixMilli())
+		recordValue(testContext(t), store, item, test.value, nil, time.Now(), 0)
+
+		r, _ := store.Get(device)
+
+		if r.Total != test.total || r.Resets != test.resets {
+			t.Errorf("%v: expected total %v and %v resets, got %+v", test.value, test.total, test.resets, r)
+		}
+	}
+
+}
@@ -33,6 +33,7 @@ import (
 	"io"
 	"io/ioutil"
 	"sort"
+	"time"
 )
 
 type OverviewTable struct {
@@ -105,7 +106,7 @@ func Max(x, y int) int {
 	return x
 }
 
-func generateTable(overviewTable *OverviewTable, devs *devices.Devices, details bool) Table {
+func generateTable(overviewTable *OverviewTable, devs *devices.Devices, store *Store, details bool) Table {
 	table := Table{}
 	table.Title = overviewTable.Title
 
@@ -130,6 +131,7 @@ func generateTable(overviewTable *OverviewTable, devs *devices.Devices, details
 	}
 
 	stop := start + len(overviewTable.Group)
+	now := time.Now()
 
 	for k, d := range devs.ByDID {
 		row := []TableEntry{}
@@ -156,7 +158,25 @@ func generateTable(overviewTable *OverviewTable, devs *devices.Devices, details
 							}
 						}
 					}
-					row = append(row, TableEntry{w.LastValue(), true})
+					text := ""
+
+					if r, ok := store.Get(w); ok {
+						text = r.Text
+
+						if r.IsStale(w, now) {
+							text += " (stale)"
+						}
+					}
+
+					if h, ok := store.GetHealth(w); ok && h.Suspended {
+						if text == "" {
+							text = "authentication failed"
+						} else {
+							text += " (authentication failed)"
+						}
+					}
+
+					row = append(row, TableEntry{text, true})
 					found = true
 					use = true
 					break
@@ -187,11 +207,11 @@ func generateTable(overviewTable *OverviewTable, devs *devices.Devices, details
 	return table
 }
 
-func GenerateOverview(writer io.Writer, overview *Overview, devs *devices.Devices, details bool) {
+func GenerateOverview(writer io.Writer, overview *Overview, devs *devices.Devices, store *Store, details bool) {
 	tables := make([]Table, 0)
 
 	for _, overviewTable := range overview.Tables {
-		table := generateTable(&overviewTable, devs, details)
+		table := generateTable(&overviewTable, devs, store, details)
 		widths := make([]int, len(table.Headers))
 
 		for k, v := range table.Headers {
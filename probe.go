@@ -0,0 +1,96 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+	"github.com/sirupsen/logrus"
+)
+
+// probeDevices reads every device once and prints a table of the results.
+// It returns the number of devices, which could not be read.
+func probeDevices(ctx devices.Context, devs []devices.DeviceInterface, out io.Writer) int {
+	failed := 0
+	table := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(table, "DEVICE\tMETRIC\tDATAPOINT\tVALUE\tLATENCY\tERROR")
+
+	for _, d := range devs {
+		datapoint := "-"
+
+		if dp, ok := d.(devices.Datapoint); ok {
+			datapoint = dp.Datapoint()
+		}
+
+		start := time.Now()
+		value, err := d.CurrentValue(ctx)
+		latency := time.Since(start).Round(time.Millisecond)
+
+		if err != nil {
+			failed++
+			fmt.Fprintf(table, "%s\t%s\t%s\t-\t%v\t%v\n", d.LogName(), d.MetricName(), datapoint, latency, err)
+		} else {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%g\t%v\t\n", d.LogName(), d.MetricName(), datapoint, value, latency)
+		}
+	}
+
+	table.Flush()
+	return failed
+}
+
+// runProbe loads the setup directory and reads every device once, without
+// starting the HTTP server or the poll loop. It returns the exit code of the
+// probe subcommand.
+func runProbe(name string, args []string, out io.Writer) int {
+	setup := ""
+	timeout := time.Duration(0)
+
+	flagset := flag.NewFlagSet(name+" probe", flag.ExitOnError)
+	flagset.StringVar(&setup, "setup", "./setup", "The directory holding the device definitions.")
+	flagset.DurationVar(&timeout, "timeout", 10*time.Second, "The timeout for reading a single device.")
+	flagset.Parse(args)
+
+	ctx := devices.Context{
+		NetClient: &http.Client{Timeout: timeout},
+		Clog:      logrus.WithField("task", "probe devices"),
+	}
+
+	devs := devices.LoadDevices(setup, ctx.NetClient)
+
+	if failed := probeDevices(ctx, deviceSeries(&devs), out); failed > 0 {
+		fmt.Fprintf(out, "%d device(s) could not be read\n", failed)
+		return 1
+	}
+
+	return 0
+}
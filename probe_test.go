@@ -0,0 +1,173 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fceller/home2grafana/tools/ccu-jsonrpc/ccu"
+)
+
+// tasmotaHandler answers Status with the name of a plug and Status 10 with
+// two channels, unless the plug is failing.
+func tasmotaHandler(failing bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("cmnd") {
+		case "Status":
+			w.Write([]byte(`{"Status":{"DeviceName":"Kueche","FriendlyName":["Kueche"]}}`))
+		case "Status 10":
+			if failing {
+				http.Error(w, "failing", http.StatusInternalServerError)
+				return
+			}
+
+			w.Write([]byte(`{"StatusSNS":{"Time":"2026-10-17T10:00:00","ENERGY":{"Total":[1.5,2.25],"Power":[40,2]}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func writeProbeSetup(t *testing.T, tasmota string, ccuAddress string) string {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"tasmota.yaml": `
+source:
+  provider: tasmota
+  power_metric: power_watt
+  interval: 60s
+  devices:
+    - address: ` + tasmota + `
+      channels: channel
+`,
+		"homematic.yaml": `
+source:
+  provider: homematic-jsonrpc
+  address: ` + ccuAddress + `
+  user_name: Admin
+  password: secret
+  energy_metric: energy_watthour
+  interval: 60s
+  devices:
+    - hm_name: HmIP-RF.0001DD89971DDD
+`,
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func runProbeTest(t *testing.T, failing bool) (int, string) {
+	plug := httptest.NewServer(tasmotaHandler(failing))
+	defer plug.Close()
+
+	ccuServer := httptest.NewServer(ccu.NewServer(ccu.Fixtures(), "Admin", "secret", 0))
+	defer ccuServer.Close()
+
+	setup := writeProbeSetup(t, plug.Listener.Addr().String(), ccuServer.Listener.Addr().String())
+	out := bytes.Buffer{}
+	code := runProbe("home2grafana", []string{"-setup", setup, "-timeout", "5s"}, &out)
+
+	return code, out.String()
+}
+
+// probeRow returns the fields of the row of the table containing the
+// datapoint.
+func probeRow(t *testing.T, table string, datapoint string) []string {
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+
+		for _, f := range fields {
+			if f == datapoint {
+				return fields
+			}
+		}
+	}
+
+	t.Fatalf("no row for %s in\n%s", datapoint, table)
+	return nil
+}
+
+func TestProbe(t *testing.T) {
+	code, table := runProbeTest(t, false)
+
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d\n%s", code, table)
+	}
+
+	if !strings.HasPrefix(table, "DEVICE") || !strings.Contains(strings.Split(table, "\n")[0], "DATAPOINT") {
+		t.Errorf("expected a header, got\n%s", table)
+	}
+
+	rows := map[string]string{
+		"StatusSNS.ENERGY.Power[1]":               "40",
+		"StatusSNS.ENERGY.Power[2]":               "2",
+		"HmIP-RF.0001DD89971DDD:6.ENERGY_COUNTER": "184523.7",
+	}
+
+	for datapoint, value := range rows {
+		row := probeRow(t, table, datapoint)
+
+		// the error column of a successful read is empty
+		if row[len(row)-2] != value {
+			t.Errorf("expected %s for %s, got %v", value, datapoint, row)
+		}
+	}
+
+	if !strings.Contains(table, "(HMIP-PSM)") {
+		t.Errorf("expected the HssType in\n%s", table)
+	}
+}
+
+func TestProbeFailure(t *testing.T) {
+	code, table := runProbeTest(t, true)
+
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d\n%s", code, table)
+	}
+
+	// the channels of a plug, which fails while loading, are not known
+	row := strings.Join(probeRow(t, table, "Tasmota(Kueche)"), " ")
+
+	if !strings.Contains(row, "pending discovery") || !strings.Contains(row, "500") {
+		t.Errorf("expected a pending plug and the status in the error, got %v", row)
+	}
+
+	if !strings.Contains(table, "1 device(s) could not be read") {
+		t.Errorf("expected the number of failed devices in\n%s", table)
+	}
+}
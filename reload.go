@@ -0,0 +1,206 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+	"github.com/sirupsen/logrus"
+)
+
+// Reloader loads the setup directory again and hands the new devices to
+// the scheduler and the store. A failed reload keeps the previous setup. New
+// series continue from the persisted state.
+type Reloader struct {
+	setup     string
+	client    *http.Client
+	state     *State
+	scheduler *Scheduler
+	receiver  *devices.HomematicReceiver
+	mu        sync.Mutex
+}
+
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clog := logrus.WithField("task", "reload setup")
+
+	globalMu.RLock()
+	previous := GlobalDevices
+	globalMu.RUnlock()
+
+	devs, err := devices.ReloadDevices(r.setup, previous, r.client)
+
+	if err != nil {
+		return err
+	}
+
+	// a device, which is not available, must not replace the devices
+	// loaded completely before
+	if devs.Incomplete() && !previous.Incomplete() {
+		return errors.New("some devices are not available")
+	}
+
+	if devs.IsEmpty() && !devs.Incomplete() {
+		return errors.New("no devices have been defined")
+	}
+
+	overview, err := LoadOverviewDesc(r.setup)
+
+	if err != nil {
+		return err
+	}
+
+	for id := range previous.ByDID {
+		if _, ok := devs.ByDID[id]; !ok {
+			clog.WithField("device", id).Info("removed device")
+		}
+	}
+
+	for id := range devs.ByDID {
+		if _, ok := previous.ByDID[id]; !ok {
+			clog.WithField("device", id).Info("added device")
+		}
+	}
+
+	globalMu.Lock()
+	GlobalDevices = &devs
+	GlobalOverview = overview
+	globalMu.Unlock()
+
+	series := deviceSeries(&devs)
+	r.state.Merge(GlobalStore)
+	GlobalStore.Replace(series)
+	r.scheduler.Reload(deviceItems(series, r.state))
+
+	if r.receiver != nil {
+		r.receiver.Register(&devs)
+	}
+
+	return nil
+}
+
+func (r *Reloader) reloadAndLog(reason string) {
+	clog := logrus.WithFields(logrus.Fields{"task": "reload setup", "reason": reason})
+	clog.Info("reloading setup")
+
+	if err := r.Reload(); err != nil {
+		clog.WithError(err).Warn("cannot reload setup, keeping previous setup")
+	} else {
+		clog.Info("reloaded setup")
+	}
+}
+
+func (r *Reloader) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		r.reloadAndLog("SIGHUP")
+	}
+}
+
+// retryInterval is the time after which a setup, which could not be loaded
+// completely, is loaded again.
+const retryInterval = time.Minute
+
+// handleReloadRequests reloads the setup, when a device, which was not
+// available while loading, answers. Without such a device, an incomplete
+// setup is loaded again periodically.
+func (r *Reloader) handleReloadRequests() {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case reason := <-devices.ReloadRequests():
+			r.reloadAndLog(reason)
+		case <-ticker.C:
+			globalMu.RLock()
+			retry := GlobalDevices.NeedsRetry()
+			globalMu.RUnlock()
+
+			if retry {
+				r.reloadAndLog("setup incomplete")
+			}
+		}
+	}
+}
+
+// watch reloads the setup whenever a file in the setup directory has been
+// added, removed or modified.
+func (r *Reloader) watch(interval time.Duration) {
+	last, err := fingerprint(r.setup)
+
+	if err != nil {
+		logrus.WithError(err).Warn("cannot watch setup directory")
+	}
+
+	for range time.Tick(interval) {
+		current, err := fingerprint(r.setup)
+
+		if err != nil {
+			logrus.WithError(err).Warn("cannot watch setup directory")
+			continue
+		}
+
+		if current != last {
+			last = current
+			r.reloadAndLog("setup directory changed")
+		}
+	}
+}
+
+func fingerprint(setup string) (string, error) {
+	entries := make([]string, 0)
+
+	err := filepath.Walk(setup, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			entries = append(entries, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+		}
+
+		return nil
+	})
+
+	sort.Strings(entries)
+	return strings.Join(entries, "\n"), err
+}
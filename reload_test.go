@@ -0,0 +1,97 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/fceller/home2grafana/devices"
+	"github.com/sirupsen/logrus"
+)
+
+// TestReloadRestoresState checks that a series added by a reload continues
+// from the persisted state.
+func TestReloadRestoresState(t *testing.T) {
+	plug := httptest.NewServer(tasmotaHandler(false))
+	defer plug.Close()
+
+	dir := t.TempDir()
+	address := plug.Listener.Addr().String()
+
+	files := map[string]string{
+		"overview.yaml": "",
+		"overview.html": "",
+		"tasmota.yaml": `
+source:
+  provider: tasmota
+  energy_metric: energy_watthour
+  interval: 60s
+  devices:
+    - address: ` + address + `
+      name: Kueche
+      channels: sum
+`,
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	devs, store := GlobalDevices, GlobalStore
+	t.Cleanup(func() { GlobalDevices, GlobalStore = devs, store })
+
+	GlobalDevices = &devices.Devices{}
+	GlobalStore = NewStore()
+
+	key := "tasmota: " + address + "/energy/energy_watthour"
+	state := &State{Series: map[string]SeriesState{key: {Last: 3750, Time: 1000, Total: 12000, Resets: 1}}}
+	ctx := devices.Context{NetClient: http.DefaultClient, Clog: logrus.WithField("test", t.Name())}
+	scheduler := NewScheduler(ctx, GlobalStore, 1, nil)
+	reloader := &Reloader{setup: dir, client: http.DefaultClient, state: state, scheduler: scheduler}
+
+	errs := make(chan error, 1)
+	go func() { errs <- reloader.Reload() }()
+
+	items := <-scheduler.updates
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 1 || seriesKey(items[0].methods) != key {
+		t.Fatalf("expected the energy series of the plug, got %d items", len(items))
+	}
+
+	if items[0].total != 12000 || items[0].resets != 1 || items[0].last != 3750 {
+		t.Errorf("expected the persisted state, got total %v, resets %v, last %v",
+			items[0].total, items[0].resets, items[0].last)
+	}
+}
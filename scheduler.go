@@ -0,0 +1,419 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+	"github.com/sirupsen/logrus"
+)
+
+type Scheduler struct {
+	ctx       devices.Context
+	store     *Store
+	queue     PriorityQueue
+	workers   chan struct{}
+	limits    map[string]int
+	endpoints map[string]chan struct{}
+	done      chan *DeviceItem
+	updates   chan []*DeviceItem
+	active    map[string]*DeviceItem
+	pending   map[*DeviceItem]devices.DeviceInterface
+	removed   map[*DeviceItem]bool
+	blocked   map[string]bool
+	suspended map[*DeviceItem]bool
+	pushed    chan devices.HomematicEvent
+	deferred  map[*DeviceItem]devices.HomematicEvent
+}
+
+// ParseLimits parses a list of "provider=N" pairs. N is the maximal number
+// of parallel requests against a single endpoint of that provider.
+func ParseLimits(spec string) (map[string]int, error) {
+	limits := make(map[string]int)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid limit '%s', expecting provider=N", entry)
+		}
+
+		n, err := strconv.Atoi(kv[1])
+
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid limit '%s', expecting a positive number", entry)
+		}
+
+		limits[strings.TrimSpace(kv[0])] = n
+	}
+
+	return limits, nil
+}
+
+func NewScheduler(ctx devices.Context, store *Store, workers int, limits map[string]int) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &Scheduler{
+		ctx:       ctx,
+		store:     store,
+		queue:     make(PriorityQueue, 0),
+		workers:   make(chan struct{}, workers),
+		limits:    limits,
+		endpoints: make(map[string]chan struct{}),
+		done:      make(chan *DeviceItem),
+		updates:   make(chan []*DeviceItem),
+		active:    make(map[string]*DeviceItem),
+		pending:   make(map[*DeviceItem]devices.DeviceInterface),
+		removed:   make(map[*DeviceItem]bool),
+		blocked:   make(map[string]bool),
+		suspended: make(map[*DeviceItem]bool),
+		pushed:    make(chan devices.HomematicEvent),
+		deferred:  make(map[*DeviceItem]devices.HomematicEvent),
+	}
+}
+
+func endpointKey(d devices.DeviceInterface) string {
+	return d.ProviderName() + "|" + d.Endpoint()
+}
+
+// endpoint returns the semaphore guarding the endpoint of a device. Devices
+// of the same provider reading from the same endpoint share the semaphore.
+func (s *Scheduler) endpoint(d devices.DeviceInterface) chan struct{} {
+	provider := d.ProviderName()
+	key := endpointKey(d)
+	sem, ok := s.endpoints[key]
+
+	if !ok {
+		limit, ok := s.limits[provider]
+
+		if !ok {
+			limit = 1
+		}
+
+		sem = make(chan struct{}, limit)
+		s.endpoints[key] = sem
+	}
+
+	return sem
+}
+
+// Run polls the items forever. Due items are handed to a goroutine, which
+// waits for a free slot on the endpoint and in the worker pool. The item is
+// put back into the queue once it has been read.
+func (s *Scheduler) Run(items []*DeviceItem) {
+	s.update(items)
+
+	for {
+		var timer *time.Timer
+		var expired <-chan time.Time
+
+		if s.queue.Len() > 0 {
+			wait := time.Until(time.Unix(s.queue[0].expiry, 0))
+
+			if wait <= 0 {
+				item := heap.Pop(&s.queue).(*DeviceItem)
+
+				if s.blocked[endpointKey(item.methods)] {
+					s.suspend(item)
+					continue
+				}
+
+				if reader, ok := item.methods.(devices.BatchReader); ok {
+					go s.pollBatch(reader, s.batch(item, reader), s.endpoint(item.methods))
+				} else {
+					go s.poll(item, s.endpoint(item.methods))
+				}
+
+				continue
+			}
+
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		select {
+		case item := <-s.done:
+			s.finish(item)
+		case items := <-s.updates:
+			s.update(items)
+		case event := <-s.pushed:
+			s.push(event)
+		case <-expired:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Reload replaces the set of polled items. Items are matched by their
+// series key. A matching item keeps its state and only takes over the new
+// device, items without a match are added or removed.
+func (s *Scheduler) Reload(items []*DeviceItem) {
+	s.updates <- items
+}
+
+func (s *Scheduler) update(items []*DeviceItem) {
+	// a reload might have fixed the credentials, retry all endpoints
+	for item := range s.suspended {
+		item.suspended = false
+		item.expiry = time.Now().Unix()
+		heap.Push(&s.queue, item)
+	}
+
+	s.suspended = make(map[*DeviceItem]bool)
+	s.blocked = make(map[string]bool)
+
+	wanted := make(map[string]*DeviceItem)
+
+	for _, item := range items {
+		key := seriesKey(item.methods)
+
+		if _, ok := wanted[key]; ok {
+			s.ctx.Clog.WithField("series", key).Warn("ignoring duplicate series")
+			continue
+		}
+
+		wanted[key] = item
+	}
+
+	for key, item := range s.active {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+
+		delete(s.active, key)
+
+		if item.index >= 0 {
+			heap.Remove(&s.queue, item.index)
+		} else {
+			s.removed[item] = true
+		}
+	}
+
+	for key, item := range wanted {
+		current, ok := s.active[key]
+
+		if !ok {
+			s.active[key] = item
+			heap.Push(&s.queue, item)
+		} else if current.methods != item.methods {
+			if current.index >= 0 {
+				current.methods = item.methods
+			} else {
+				s.pending[current] = item.methods
+			}
+		}
+	}
+}
+
+// Push hands a value pushed by a device to the scheduler.
+func (s *Scheduler) Push(event devices.HomematicEvent) {
+	s.pushed <- event
+}
+
+// push records a pushed value and delays the next poll by the interval, so
+// that a device is only polled once its events stop. The value of an item,
+// which is read at the moment, is recorded after the read.
+func (s *Scheduler) push(event devices.HomematicEvent) {
+	item, ok := s.active[seriesKey(event.Device)]
+
+	if !ok || s.suspended[item] {
+		return
+	}
+
+	if item.index < 0 {
+		s.deferred[item] = event
+		return
+	}
+
+	s.record(item, event)
+	heap.Fix(&s.queue, item.index)
+}
+
+func (s *Scheduler) record(item *DeviceItem, event devices.HomematicEvent) {
+	ctx := devices.Context{
+		Root:      s.ctx.Root,
+		NetClient: s.ctx.NetClient,
+		Clog:      s.ctx.Clog.WithFields(logrus.Fields{"device": item.methods.LogName(), "pushed": true}),
+	}
+
+	// the health describes the polls, a pushed value which cannot be parsed
+	// is left to the next poll
+	if event.Err != nil {
+		ctx.Warn(event.Err, "cannot parse pushed value")
+		return
+	}
+
+	recordPushed(ctx, s.store, item, event.Value, event.Time)
+	item.expiry = time.Now().Unix() + int64(item.methods.IntervalSec())
+}
+
+// finish puts an item back into the queue, unless it has been removed by a
+// reload while it was read.
+func (s *Scheduler) finish(item *DeviceItem) {
+	event, pushed := s.deferred[item]
+	delete(s.deferred, item)
+
+	if s.removed[item] {
+		delete(s.removed, item)
+		delete(s.pending, item)
+		return
+	}
+
+	if methods, ok := s.pending[item]; ok {
+		item.methods = methods
+		delete(s.pending, item)
+	}
+
+	if item.suspended {
+		key := endpointKey(item.methods)
+
+		if !s.blocked[key] {
+			s.ctx.Clog.WithField("endpoint", key).Warn("credentials rejected, polling suspended")
+			s.blocked[key] = true
+		}
+
+		s.suspend(item)
+		return
+	}
+
+	if pushed {
+		s.record(item, event)
+	}
+
+	heap.Push(&s.queue, item)
+}
+
+// suspend stops polling an item, whose endpoint has rejected the
+// credentials. The item is polled again after the next reload.
+func (s *Scheduler) suspend(item *DeviceItem) {
+	if !item.suspended {
+		item.suspended = true
+
+		if h, ok := s.store.GetHealth(item.methods); ok {
+			h.Suspended = true
+			s.store.SetHealth(item.methods, h)
+		} else {
+			s.store.SetHealth(item.methods, Health{Errors: map[string]float64{}, Suspended: true})
+		}
+	}
+
+	s.suspended[item] = true
+}
+
+// batch removes all items from the queue, which share the batch key of the
+// reader and are due within half of their interval. They are read together
+// with the item and will be due at the same time afterwards.
+func (s *Scheduler) batch(item *DeviceItem, reader devices.BatchReader) []*DeviceItem {
+	key := reader.BatchKey()
+	now := time.Now().Unix()
+	items := []*DeviceItem{item}
+
+	for i := 0; i < len(s.queue); {
+		other := s.queue[i]
+		r, ok := other.methods.(devices.BatchReader)
+
+		if ok && r.BatchKey() == key && other.expiry <= now+int64(other.methods.IntervalSec()/2) {
+			heap.Remove(&s.queue, i)
+			items = append(items, other)
+			i = 0
+		} else {
+			i++
+		}
+	}
+
+	return items
+}
+
+func (s *Scheduler) pollBatch(reader devices.BatchReader, items []*DeviceItem, endpoint chan struct{}) {
+	endpoint <- struct{}{}
+	s.workers <- struct{}{}
+
+	batch := make([]devices.DeviceInterface, len(items))
+
+	for i, item := range items {
+		batch[i] = item.methods
+	}
+
+	ctx := devices.Context{
+		Root:      s.ctx.Root,
+		NetClient: s.ctx.NetClient,
+		Clog:      s.ctx.Clog.WithField("batch", reader.BatchKey()),
+	}
+
+	start := time.Now()
+	values, errs := reader.ReadBatch(ctx, batch)
+	duration := time.Since(start)
+
+	for i, item := range items {
+		ctx.PushField("device", item.methods.LogName())
+		factor := recordValue(ctx, s.store, item, values[i], errs[i], start, duration)
+		ctx.Pop()
+
+		item.expiry = time.Now().Unix() + int64(item.methods.IntervalSec()*factor)
+	}
+
+	<-s.workers
+	<-endpoint
+
+	for _, item := range items {
+		s.done <- item
+	}
+}
+
+func (s *Scheduler) poll(item *DeviceItem, endpoint chan struct{}) {
+	endpoint <- struct{}{}
+	s.workers <- struct{}{}
+
+	ctx := devices.Context{
+		Root:      s.ctx.Root,
+		NetClient: s.ctx.NetClient,
+		Clog:      s.ctx.Clog.WithField("device", item.methods.LogName()),
+	}
+
+	factor := readDevice(ctx, s.store, item)
+	item.expiry = time.Now().Unix() + int64(item.methods.IntervalSec()*factor)
+
+	<-s.workers
+	<-endpoint
+
+	s.done <- item
+}
@@ -0,0 +1,228 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeDevice is a device returning a fixed value.
+type fakeDevice struct {
+	id       string
+	category string
+	provider string
+	endpoint string
+	batchKey string
+	value    float64
+	err      error
+}
+
+func (f *fakeDevice) DeviceID() string                              { return f.id }
+func (f *fakeDevice) MetricName() string                            { return f.category + "_metric" }
+func (f *fakeDevice) Name() string                                  { return f.id }
+func (f *fakeDevice) Room() string                                  { return "" }
+func (f *fakeDevice) FullName() string                              { return f.id }
+func (f *fakeDevice) LogName() string                               { return f.id }
+func (f *fakeDevice) LabelNames() []string                          { return []string{"provider", "name", "room"} }
+func (f *fakeDevice) Labels() []string                              { return []string{f.provider, f.id, ""} }
+func (f *fakeDevice) CategoryName() string                          { return f.category }
+func (f *fakeDevice) ProviderName() string                          { return f.provider }
+func (f *fakeDevice) Endpoint() string                              { return f.endpoint }
+func (f *fakeDevice) IntervalSec() uint64                           { return 60 }
+func (f *fakeDevice) Stale() devices.Staleness                      { return devices.Staleness{} }
+func (f *fakeDevice) CurrentValue(devices.Context) (float64, error) { return f.value, f.err }
+func (f *fakeDevice) LastValue() string                             { return "" }
+
+func testContext(t *testing.T) devices.Context {
+	return devices.Context{NetClient: http.DefaultClient, Clog: logrus.WithField("test", t.Name())}
+}
+
+// TestPushKeepsPollHealth checks that a pushed value updates the value and
+// the time of the latest success only.
+func TestPushKeepsPollHealth(t *testing.T) {
+	device := &fakeDevice{id: "hm", category: "power", provider: "homematic", endpoint: "ccu"}
+	store := NewStore()
+	store.Replace([]devices.DeviceInterface{device})
+	scheduler := NewScheduler(testContext(t), store, 1, nil)
+	item := newDeviceItem(device, nil, time.Now().UnixMilli())
+	scheduler.active[seriesKey(device)] = item
+
+	polled := time.Now().Add(-time.Minute)
+	recordValue(testContext(t), store, item, 40, nil, polled, 2*time.Second)
+
+	pushed := time.Now()
+	scheduler.record(item, devices.HomematicEvent{Device: device, Value: 55, Time: pushed})
+	parseErr := &devices.ParseError{Err: errors.New("no number")}
+	scheduler.record(item, devices.HomematicEvent{Device: device, Err: parseErr, Time: pushed})
+
+	h, _ := store.GetHealth(device)
+	r, _ := store.Get(device)
+
+	if h.Duration != 2*time.Second || !h.Up || h.Errors[errorParse] != 0 {
+		t.Errorf("expected the health of the poll, got %+v", h)
+	}
+
+	if !h.LastSuccess.Equal(pushed) || r.Value != 55 || !r.Time.Equal(pushed) {
+		t.Errorf("expected the pushed value at %v, got %+v, last success %v", pushed, r, h.LastSuccess)
+	}
+}
+
+// fakeBatchDevice is a device read together with the devices sharing its
+// batch key.
+type fakeBatchDevice struct {
+	fakeDevice
+	reads *[][]devices.DeviceInterface
+}
+
+func (f *fakeBatchDevice) BatchKey() string {
+	return f.batchKey
+}
+
+func (f *fakeBatchDevice) ReadBatch(ctx devices.Context, batch []devices.DeviceInterface) ([]float64, []error) {
+	*f.reads = append(*f.reads, batch)
+	values := make([]float64, len(batch))
+	errs := make([]error, len(batch))
+
+	for i, d := range batch {
+		values[i], errs[i] = d.CurrentValue(ctx)
+	}
+
+	return values, errs
+}
+
+func TestBatchGrouping(t *testing.T) {
+	reads := [][]devices.DeviceInterface{}
+	device := func(id string, key string) *fakeBatchDevice {
+		fake := fakeDevice{id: id, category: "power", provider: "homematic", endpoint: key, batchKey: key}
+		return &fakeBatchDevice{fake, &reads}
+	}
+
+	scheduler := NewScheduler(testContext(t), NewStore(), 1, nil)
+	now := time.Now().Unix()
+
+	first := newDeviceItem(device("a1", "ccu1"), nil, 0)
+	plain := &fakeDevice{id: "c1", category: "power", provider: "homematic", endpoint: "ccu1"}
+	queued := map[string]*DeviceItem{
+		"same key, due":           newDeviceItem(device("a2", "ccu1"), nil, 0),
+		"same key, due soon":      newDeviceItem(device("a3", "ccu1"), nil, 0),
+		"same key, not due":       newDeviceItem(device("a4", "ccu1"), nil, 0),
+		"other key, due":          newDeviceItem(device("b1", "ccu2"), nil, 0),
+		"not a batch reader, due": newDeviceItem(plain, nil, 0),
+	}
+
+	queued["same key, due"].expiry = now
+	queued["same key, due soon"].expiry = now + 29
+	queued["same key, not due"].expiry = now + 31
+	queued["other key, due"].expiry = now
+	queued["not a batch reader, due"].expiry = now
+
+	for _, item := range queued {
+		heap.Push(&scheduler.queue, item)
+	}
+
+	batch := scheduler.batch(first, first.methods.(devices.BatchReader))
+	ids := make(map[string]bool)
+
+	for _, item := range batch {
+		ids[item.methods.DeviceID()] = true
+	}
+
+	if len(batch) != 3 || batch[0] != first || !ids["a2"] || !ids["a3"] {
+		t.Errorf("expected a1, a2 and a3 in the batch, got %v", ids)
+	}
+
+	if scheduler.queue.Len() != 3 {
+		t.Errorf("expected the other items to stay queued, got %d", scheduler.queue.Len())
+	}
+
+	for i, item := range scheduler.queue {
+		if item.index != i {
+			t.Errorf("queue index of %s is %d, expected %d", item.methods.DeviceID(), item.index, i)
+		}
+	}
+}
+
+func TestPollBatch(t *testing.T) {
+	reads := [][]devices.DeviceInterface{}
+	ok := &fakeBatchDevice{fakeDevice{id: "ok", category: "power", provider: "homematic", endpoint: "ccu", batchKey: "ccu",
+		value: 40}, &reads}
+	failing := &fakeBatchDevice{fakeDevice{id: "failing", category: "power", provider: "homematic", endpoint: "ccu",
+		batchKey: "ccu", err: &devices.ParseError{Err: errors.New("no number")}}, &reads}
+
+	store := NewStore()
+	store.Replace([]devices.DeviceInterface{ok, failing})
+	scheduler := NewScheduler(testContext(t), store, 1, nil)
+	items := []*DeviceItem{newDeviceItem(ok, nil, 0), newDeviceItem(failing, nil, 0)}
+
+	go scheduler.pollBatch(ok, items, scheduler.endpoint(ok))
+
+	for range items {
+		<-scheduler.done
+	}
+
+	if len(reads) != 1 || len(reads[0]) != 2 {
+		t.Fatalf("expected a single read of both devices, got %v", reads)
+	}
+
+	if r, valid := store.Get(ok); !valid || r.Value != 40 {
+		t.Errorf("expected the value of the batch, got %+v", r)
+	}
+
+	if h, _ := store.GetHealth(failing); h.Up || h.Errors[errorParse] != 1 {
+		t.Errorf("expected the error of the failing device, got %+v", h)
+	}
+
+	// a failing device is polled later
+	if items[1].expiry <= items[0].expiry {
+		t.Errorf("expected the failing device to be delayed, got %d and %d", items[0].expiry, items[1].expiry)
+	}
+}
+
+func TestEndpointLimits(t *testing.T) {
+	scheduler := NewScheduler(testContext(t), NewStore(), 4, map[string]int{"tasmota": 3})
+
+	ccu := &fakeDevice{provider: "homematic", endpoint: "ccu"}
+	other := &fakeDevice{provider: "homematic", endpoint: "ccu2"}
+	plug := &fakeDevice{provider: "tasmota", endpoint: "ccu"}
+
+	if scheduler.endpoint(ccu) != scheduler.endpoint(&fakeDevice{provider: "homematic", endpoint: "ccu"}) {
+		t.Error("expected devices of the same endpoint to share the semaphore")
+	}
+
+	if scheduler.endpoint(ccu) == scheduler.endpoint(other) || scheduler.endpoint(ccu) == scheduler.endpoint(plug) {
+		t.Error("expected other endpoints and providers to use their own semaphore")
+	}
+
+	if cap(scheduler.endpoint(ccu)) != 1 || cap(scheduler.endpoint(plug)) != 3 {
+		t.Errorf("expected limits 1 and 3, got %d and %d", cap(scheduler.endpoint(ccu)), cap(scheduler.endpoint(plug)))
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+	"github.com/sirupsen/logrus"
+)
+
+const stateFile = "state.json"
+
+// SeriesState is the persisted state of an energy series.
+type SeriesState struct {
+	Last   float64 `json:"last"`
+	Time   int64   `json:"time"`
+	Total  float64 `json:"total"`
+	Resets float64 `json:"resets"`
+}
+
+// State holds the persisted series. It is kept for the lifetime of the
+// process, so a series without a fresh reading keeps its persisted state.
+type State struct {
+	mu     sync.Mutex
+	Series map[string]SeriesState `json:"series"`
+}
+
+func seriesKey(d devices.DeviceInterface) string {
+	return fmt.Sprintf("%s/%s/%s", d.DeviceID(), d.CategoryName(), d.MetricName())
+}
+
+// LoadState reads the state file from the state directory. A missing file
+// results in an empty state.
+func LoadState(dir string) (*State, error) {
+	state := &State{Series: make(map[string]SeriesState)}
+
+	if dir == "" {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	if state.Series == nil {
+		state.Series = make(map[string]SeriesState)
+	}
+
+	return state, nil
+}
+
+// SaveState merges the energy series of the store into the state and writes
+// it to the state directory. Series without a valid reading, e.g. of a meter
+// being offline, keep their previous state. The file is replaced atomically,
+// so a crash never leaves a partial file.
+func SaveState(dir string, store *Store, state *State) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.merge(store)
+	data, err := json.MarshalIndent(state, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, stateFile+".*")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, stateFile))
+}
+
+// Merge takes the energy series with a valid reading from the store, so
+// that a series removed by a reload continues from its last reading, if it
+// is added again.
+func (s *State) Merge(store *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.merge(store)
+}
+
+func (s *State) merge(store *Store) {
+	for _, entry := range store.Snapshot() {
+		if !entry.Valid || entry.Device.CategoryName() != "energy" {
+			continue
+		}
+
+		s.Series[seriesKey(entry.Device)] = SeriesState{
+			Last:   entry.Reading.Value,
+			Time:   entry.Reading.Time.UnixMilli(),
+			Total:  entry.Reading.Total,
+			Resets: entry.Reading.Resets,
+		}
+	}
+}
+
+func saveStatePeriodically(dir string, store *Store, state *State, interval time.Duration) {
+	clog := logrus.WithField("task", "save state")
+
+	for range time.Tick(interval) {
+		if err := SaveState(dir, store, state); err != nil {
+			clog.WithError(err).Warn("cannot save state")
+		}
+	}
+}
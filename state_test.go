@@ -0,0 +1,119 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	meter := &fakeDevice{id: "meter", category: "energy", provider: "tasmota", endpoint: "plug"}
+	offline := &fakeDevice{id: "offline", category: "energy", provider: "tasmota", endpoint: "plug"}
+	power := &fakeDevice{id: "meter", category: "power", provider: "tasmota", endpoint: "plug"}
+
+	store := NewStore()
+	store.Replace([]devices.DeviceInterface{meter, offline, power})
+	at := time.UnixMilli(1700000000000)
+	store.Set(meter, Reading{Value: 1300, Time: at, Total: 500, Resets: 1})
+	store.Set(power, Reading{Value: 40, Time: at})
+
+	// the offline meter has no reading and keeps its loaded state
+	state := &State{Series: map[string]SeriesState{seriesKey(offline): {Last: 10, Time: 1, Total: 20, Resets: 0}}}
+
+	if err := SaveState(dir, store, state); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadState(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]SeriesState{
+		seriesKey(meter):   {Last: 1300, Time: at.UnixMilli(), Total: 500, Resets: 1},
+		seriesKey(offline): {Last: 10, Time: 1, Total: 20, Resets: 0},
+	}
+
+	if !reflect.DeepEqual(loaded.Series, expected) {
+		t.Errorf("expected %v, got %v", expected, loaded.Series)
+	}
+
+	// no temporary file is left behind
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("expected only the state file, got %v", files)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		series  int
+		err     bool
+	}{
+		{"missing", "", 0, false},
+		{"empty object", "{}", 0, false},
+		{"series", `{"series":{"a/energy/e":{"last":1,"time":2,"total":3,"resets":0}}}`, 1, false},
+		{"corrupt", `{"series":{"a/energy/e":`, 0, true},
+		{"wrong type", `{"series":[]}`, 0, true},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+
+		if test.content != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, stateFile), []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		state, err := LoadState(dir)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+
+			continue
+		}
+
+		if err != nil || len(state.Series) != test.series {
+			t.Errorf("%s: expected %d series, got %v", test.name, test.series, err)
+		}
+	}
+
+	// without a state directory, nothing is read
+	if state, err := LoadState(""); err != nil || state.Series == nil {
+		t.Errorf("expected an empty state, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/fceller/home2grafana/devices"
+)
+
+// Reading is the latest state of a single series. Readings are immutable
+// once they have been handed to the store.
+type Reading struct {
+	Value  float64
+	Text   string
+	Time   time.Time
+	Total  float64
+	Resets float64
+	Rate   float64
+}
+
+// IsStale checks whether the reading of a device has outlived the staleness
+// policy of the device.
+func (r Reading) IsStale(d devices.DeviceInterface, now time.Time) bool {
+	after := d.Stale().After
+	return after > 0 && now.Sub(r.Time) > after
+}
+
+type Store struct {
+	mu       sync.RWMutex
+	series   []devices.DeviceInterface
+	known    map[devices.DeviceInterface]bool
+	readings map[devices.DeviceInterface]Reading
+	health   map[devices.DeviceInterface]Health
+}
+
+type StoreEntry struct {
+	Device  devices.DeviceInterface
+	Reading Reading
+	Valid   bool
+	Health  Health
+	Polled  bool
+}
+
+func NewStore() *Store {
+	return &Store{
+		series:   make([]devices.DeviceInterface, 0),
+		known:    make(map[devices.DeviceInterface]bool),
+		readings: make(map[devices.DeviceInterface]Reading),
+		health:   make(map[devices.DeviceInterface]Health),
+	}
+}
+
+// Replace sets the series of the store. Readings of series, which are no
+// longer present, are dropped. A series replacing a series with the same key
+// takes over its reading.
+func (s *Store) Replace(series []devices.DeviceInterface) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byKey := make(map[string]devices.DeviceInterface)
+
+	for _, d := range s.series {
+		byKey[seriesKey(d)] = d
+	}
+
+	known := make(map[devices.DeviceInterface]bool)
+	readings := make(map[devices.DeviceInterface]Reading)
+	health := make(map[devices.DeviceInterface]Health)
+
+	for _, d := range series {
+		known[d] = true
+		previous, ok := byKey[seriesKey(d)]
+
+		if !ok {
+			continue
+		}
+
+		if r, ok := s.readings[previous]; ok {
+			readings[d] = r
+		}
+
+		if h, ok := s.health[previous]; ok {
+			health[d] = h
+		}
+	}
+
+	s.series = series
+	s.known = known
+	s.readings = readings
+	s.health = health
+}
+
+// Set stores the reading of a series. Readings of unknown series, which
+// have been removed by a reload while being read, are ignored.
+func (s *Store) Set(d devices.DeviceInterface, r Reading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.known[d] {
+		s.readings[d] = r
+	}
+}
+
+// SetHealth records the outcome of the latest read. The error map must not
+// be modified afterwards.
+func (s *Store) SetHealth(d devices.DeviceInterface, h Health) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.known[d] {
+		s.health[d] = h
+	}
+}
+
+func (s *Store) Get(d devices.DeviceInterface) (Reading, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.readings[d]
+	return r, ok
+}
+
+// GetHealth returns the outcome of the latest read of a series.
+func (s *Store) GetHealth(d devices.DeviceInterface) (Health, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	h, ok := s.health[d]
+	return h, ok
+}
+
+// Snapshot returns a copy of all series and their latest readings, in the
+// order the series have been added.
+func (s *Store) Snapshot() []StoreEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]StoreEntry, len(s.series))
+
+	for i, d := range s.series {
+		r, ok := s.readings[d]
+
+		if !ok {
+			r.Rate = math.NaN()
+		}
+
+		h, polled := s.health[d]
+		entries[i] = StoreEntry{Device: d, Reading: r, Valid: ok, Health: h, Polled: polled}
+	}
+
+	return entries
+}
@@ -0,0 +1,219 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Package ccu is a stand-in for the JSON-RPC API of a Homematic CCU. It
+// answers Session.login, Device.listAllDetail, Room.getAll, SysVar.getAll and
+// Interface.getParamset from fixtures recorded on a real CCU.
+package ccu
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed fixtures/*.json
+var builtinFixtures embed.FS
+
+// Fixtures returns the fixtures recorded on a real CCU.
+func Fixtures() fs.FS {
+	sub, err := fs.Sub(builtinFixtures, "fixtures")
+
+	if err != nil {
+		panic(err)
+	}
+
+	return sub
+}
+
+type request struct {
+	Method string                 `json:"method"`
+	Params map[string]interface{} `json:"params"`
+	Id     interface{}            `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// Server answers the JSON-RPC requests. Sessions, which are idle for longer
+// than the timeout, expire.
+type Server struct {
+	fixtures fs.FS
+	userName string
+	password string
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]time.Time
+	logins   int
+}
+
+func NewServer(fixtures fs.FS, userName string, password string, timeout time.Duration) *Server {
+	return &Server{
+		fixtures: fixtures,
+		userName: userName,
+		password: password,
+		timeout:  timeout,
+		sessions: make(map[string]time.Time),
+	}
+}
+
+// Logins returns the number of successful logins.
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.logins
+}
+
+// Sessions returns the number of open sessions.
+func (s *Server) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
+}
+
+// Expire ends all sessions, as if they had been idle for too long.
+func (s *Server) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions = make(map[string]time.Time)
+}
+
+func (s *Server) fixture(name string, result interface{}) error {
+	data, err := fs.ReadFile(s.fixtures, name+".json")
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+// validSession checks the session id of a request and extends the session.
+func (s *Server) validSession(params map[string]interface{}) bool {
+	id, _ := params["_session_id_"].(string)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, ok := s.sessions[id]
+
+	if !ok || (s.timeout > 0 && time.Since(last) > s.timeout) {
+		delete(s.sessions, id)
+		return false
+	}
+
+	s.sessions[id] = time.Now()
+	return true
+}
+
+func (s *Server) handle(req request) (interface{}, *rpcError) {
+	if req.Method == "Session.login" {
+		if req.Params["username"] != s.userName || req.Params["password"] != s.password {
+			return nil, &rpcError{Code: 501, Name: "JSONRPCError", Message: "invalid credentials or too many sessions"}
+		}
+
+		id := fmt.Sprintf("%010x", rand.Int63())
+
+		s.mu.Lock()
+		s.sessions[id] = time.Now()
+		s.logins++
+		s.mu.Unlock()
+
+		return id, nil
+	}
+
+	if !s.validSession(req.Params) {
+		return nil, &rpcError{Code: 400, Name: "JSONRPCError", Message: "access denied ( " + req.Method + " )"}
+	}
+
+	switch req.Method {
+	case "Session.logout":
+		s.mu.Lock()
+		delete(s.sessions, req.Params["_session_id_"].(string))
+		s.mu.Unlock()
+
+		return true, nil
+	case "Device.listAllDetail", "Room.getAll", "SysVar.getAll":
+		var result interface{}
+
+		if err := s.fixture(req.Method, &result); err != nil {
+			return nil, &rpcError{Code: 500, Name: "JSONRPCError", Message: err.Error()}
+		}
+
+		return result, nil
+	case "Interface.getParamset":
+		paramsets := make(map[string]interface{})
+
+		if err := s.fixture(req.Method, &paramsets); err != nil {
+			return nil, &rpcError{Code: 500, Name: "JSONRPCError", Message: err.Error()}
+		}
+
+		key := fmt.Sprintf("%v|%v", req.Params["interface"], req.Params["address"])
+		paramset, ok := paramsets[key]
+
+		if !ok {
+			return nil, &rpcError{Code: 501, Name: "JSONRPCError", Message: "Unknown instance: " + key}
+		}
+
+		return paramset, nil
+	default:
+		return nil, &rpcError{Code: 401, Name: "JSONRPCError", Message: "method '" + req.Method + "' not found"}
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := request{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, rpcErr := s.handle(req)
+
+	logrus.WithFields(logrus.Fields{"method": req.Method, "error": rpcErr != nil}).Info("request")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": "1.1",
+		"result":  result,
+		"error":   rpcErr,
+		"id":      req.Id,
+	})
+}
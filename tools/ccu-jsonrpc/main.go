@@ -0,0 +1,67 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Frank Celler
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// ccu-jsonrpc is a stand-in for the JSON-RPC API of a Homematic CCU. It
+// answers from fixtures recorded on a real CCU, so that the homematic-jsonrpc
+// provider can be tested without one.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fceller/home2grafana/tools/ccu-jsonrpc/ccu"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	bind := flag.String("bind", ":8080", "The address to listen on.")
+	fixtures := flag.String("fixtures", "", "The directory holding the fixtures, the built-in fixtures are used if empty.")
+	userName := flag.String("user", "", "The user name expected by Session.login.")
+	password := flag.String("password", "", "The password expected by Session.login.")
+	timeout := flag.Duration("session-timeout", 30*time.Minute, "The time after which an idle session expires.")
+	certFile := flag.String("cert", "", "The certificate to serve HTTPS, HTTP is served if empty.")
+	keyFile := flag.String("key", "", "The private key of the certificate.")
+	flag.Parse()
+
+	files := ccu.Fixtures()
+
+	if *fixtures != "" {
+		files = os.DirFS(*fixtures)
+	}
+
+	s := ccu.NewServer(files, *userName, *password, *timeout)
+
+	http.Handle("/api/homematic.cgi", s)
+	logrus.Info("listening on ", *bind)
+
+	if *certFile != "" {
+		logrus.Fatal(http.ListenAndServeTLS(*bind, *certFile, *keyFile, nil))
+	}
+
+	logrus.Fatal(http.ListenAndServe(*bind, nil))
+}